@@ -1,8 +1,10 @@
 package dify
 
 import (
+	"iter"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/curtisnewbie/miso/errs"
 	"github.com/curtisnewbie/miso/miso"
@@ -13,7 +15,18 @@ var (
 )
 
 type Api struct {
-	host func() string
+	host    func() string
+	retry   *RetryPolicy
+	limiter *rateLimiter
+	breaker *CircuitBreaker
+	pool    *HostPool
+	scope   string // name of the app or dataset in KeyRegistry
+
+	retrieveCache *RetrieveCache
+
+	base          http.RoundTripper
+	timeout       time.Duration
+	streamTimeout time.Duration
 }
 
 // Setup default Api.
@@ -21,6 +34,11 @@ func SetupApi(host func() string) {
 	defaultApi = NewApi(host)
 }
 
+// Replace default Api, e.g., Api with retry policy or host pool.
+func SetDefaultApi(a Api) {
+	defaultApi = a
+}
+
 func NewApi(host func() string) Api {
 	if host == nil {
 		panic(errs.NewErrf("host func is nil"))
@@ -31,75 +49,117 @@ func NewApi(host func() string) Api {
 }
 
 func (a Api) StreamQueryChatBot(rail miso.Rail, apiKey string, req ChatMessageReq) (ChatMessageRes, error) {
-	return StreamQueryChatBot(rail, a.host(), apiKey, req)
+	return StreamQueryChatBot(a.bind(rail), a.host(), apiKey, req)
 }
 
+// The client is created by newClient, so the transport configured in the Api (e.g., retry, rate limit and circuit breaker)
+// is not applied to the request.
 func (a Api) ApiStreamQueryChatBot(rail miso.Rail, apiKey string, newClient func() *miso.TClient, req any) (ChatMessageRes, error) {
-	return ApiStreamQueryChatBot(rail, newClient, apiKey, req)
+	return ApiStreamQueryChatBot(a.bind(rail), newClient, apiKey, req)
 }
 
 func (a Api) ProxyStreamQueryChatBot(rail miso.Rail, apiKey string, req ChatMessageReq, w http.ResponseWriter, r *http.Request, appendSseData ...func() string) (ChatMessageRes, error) {
-	return ProxyStreamQueryChatBot(rail, a.host(), apiKey, req, w, r, appendSseData...)
+	return ProxyStreamQueryChatBot(a.bind(rail), a.host(), apiKey, req, w, r, appendSseData...)
+}
+
+func (a Api) ProxyWsChat(rail miso.Rail, apiKey string, w http.ResponseWriter, r *http.Request, prepare func(req *ChatMessageReq) error, opts ...func(c *ProxyConfig)) {
+	ProxyWsChat(a.bind(rail), a.host(), apiKey, w, r, prepare, opts...)
+}
+
+func (a Api) StreamChat(rail miso.Rail, apiKey string, req ChatMessageReq) iter.Seq2[ChatStreamEvent, error] {
+	return StreamChat(a.bind(rail), a.host(), apiKey, req)
+}
+
+func (a Api) StopChatMessage(rail miso.Rail, apiKey string, req StopChatMessageReq) error {
+	return StopChatMessage(a.bind(rail), a.host(), apiKey, req)
+}
+
+func (a Api) ProxyChat(rail miso.Rail, apiKey string, req ChatMessageReq, w http.ResponseWriter, r *http.Request, opts ...func(c *ProxyConfig)) (ChatMessageRes, error) {
+	return ProxyChat(a.bind(rail), a.host(), apiKey, req, w, r, opts...)
 }
 
 func (a Api) GetConversationVar(rail miso.Rail, apiKey string, req GetConversationVarReq) (GetConversationVarRes, error) {
-	return GetConversationVar(rail, a.host(), apiKey, req)
+	return GetConversationVar(a.bind(rail), a.host(), apiKey, req)
 }
 
 func (a Api) CreateDataset(rail miso.Rail, apiKey string, r CreateDatasetReq) (CreateDatasetRes, error) {
-	return CreateDataset(rail, a.host(), apiKey, r)
+	return CreateDataset(a.bind(rail), a.host(), apiKey, r)
 }
 
 func (a Api) GetDocument(rail miso.Rail, apiKey string, req GetDocumentReq) (GetDocumentRes, error) {
-	return GetDocument(rail, a.host(), apiKey, req)
+	return GetDocument(a.bind(rail), a.host(), apiKey, req)
 }
 
 func (a Api) AddDocumentSegment(rail miso.Rail, apiKey string, req AddDocumentSegmentReq) ([]AddDocumentSegmentRes, error) {
-	return AddDocumentSegment(rail, a.host(), apiKey, req)
+	return AddDocumentSegment(a.bind(rail), a.host(), apiKey, req)
 }
 
 func (a Api) AddDocumentChildSegment(rail miso.Rail, apiKey string, req AddDocumentChildSegmentReq) (AddDocumentChildSegmentRes, error) {
-	return AddDocumentChildSegment(rail, a.host(), apiKey, req)
+	return AddDocumentChildSegment(a.bind(rail), a.host(), apiKey, req)
+}
+
+func (a Api) BulkAddSegments(rail miso.Rail, apiKey string, req BulkAddSegmentsReq) (BulkAddSegmentsReport, error) {
+	return BulkAddSegments(a.bind(rail), a.host(), apiKey, req)
+}
+
+func (a Api) PushChunks(rail miso.Rail, apiKey string, req PushChunksReq) ([]AddDocumentSegmentRes, error) {
+	return PushChunks(a.bind(rail), a.host(), apiKey, req)
 }
 
 func (a Api) UploadDocument(rail miso.Rail, apiKey string, req UploadDocumentReq) (UploadDocumentRes, error) {
-	return UploadDocument(rail, a.host(), apiKey, req)
+	return UploadDocument(a.bind(rail), a.host(), apiKey, req)
 }
 
 func (a Api) RemoveDocument(rail miso.Rail, apiKey string, req RemoveDocumentReq) error {
-	return RemoveDocument(rail, a.host(), apiKey, req)
+	return RemoveDocument(a.bind(rail), a.host(), apiKey, req)
 }
 
 func (a Api) CreateDocument(rail miso.Rail, apiKey string, req CreateDocumentReq) (UploadDocumentRes, error) {
-	return CreateDocument(rail, a.host(), apiKey, req)
+	return CreateDocument(a.bind(rail), a.host(), apiKey, req)
 }
 
 func (a Api) GetDocIndexingStatus(rail miso.Rail, apiKey string, req GetDocIndexingStatusReq) ([]DocIndexingStatus, error) {
-	return GetDocIndexingStatus(rail, a.host(), apiKey, req)
+	return GetDocIndexingStatus(a.bind(rail), a.host(), apiKey, req)
 }
 
 func (a Api) UploadFile(rail miso.Rail, apiKey string, user string, file *os.File, filename string) (UploadFileRes, error) {
-	return UploadFile(rail, a.host(), apiKey, user, file, filename)
+	return UploadFile(a.bind(rail), a.host(), apiKey, user, file, filename)
 }
 
 func (a Api) SendMsgFeedback(rail miso.Rail, apiKey string, req MsgFeedbackReq) error {
-	return SendMsgFeedback(rail, a.host(), apiKey, req)
+	return SendMsgFeedback(a.bind(rail), a.host(), apiKey, req)
 }
 
 func (a Api) UpdateDocMetadata(rail miso.Rail, apiKey string, datasetId string, req UpdateDocMetadataReq) error {
-	return UpdateDocMetadata(rail, a.host(), apiKey, datasetId, req)
+	return UpdateDocMetadata(a.bind(rail), a.host(), apiKey, datasetId, req)
 }
 
 func (a Api) ListDatasetMetadata(rail miso.Rail, apiKey string, datasetId string) (ListDatasetMetadataRes, error) {
-	return ListDatasetMetadata(rail, a.host(), apiKey, datasetId)
+	return ListDatasetMetadata(a.bind(rail), a.host(), apiKey, datasetId)
 }
 
 func (a Api) Retrieve(rail miso.Rail, apiKey string, datasetId string, req RetrieveReq) (RetrieveRes, error) {
-	return Retrieve(rail, a.host(), apiKey, datasetId, req)
+	return Retrieve(a.bind(rail), a.host(), apiKey, datasetId, req)
+}
+
+func (a Api) BuildMetaFilter(rail miso.Rail, apiKey string, datasetId string, f MetaFilter) (MetadataFilteringConditions, error) {
+	return BuildMetaFilter(a.bind(rail), a.host(), apiKey, datasetId, f)
+}
+
+func (a Api) FederatedRetrieve(rail miso.Rail, apiKey string, req FederatedRetrieveReq) (FederatedRetrieveRes, error) {
+	return FederatedRetrieve(a.bind(rail), a.host(), apiKey, req)
+}
+
+func (a Api) ResolveCitations(rail miso.Rail, apiKey string, l []Citation) []Citation {
+	return ResolveCitations(a.bind(rail), a.host(), apiKey, l)
+}
+
+func (a Api) ProxyCitations(rail miso.Rail, apiKey string, format string) func(c *ProxyConfig) {
+	return ProxyCitations(a.bind(rail), a.host(), apiKey, format)
 }
 
 func (a Api) RunWorkflow(rail miso.Rail, apiKey string, req WorkflowReq) (WorkflowRes, error) {
-	return RunWorkflow(rail, a.host(), apiKey, req)
+	return RunWorkflow(a.bind(rail), a.host(), apiKey, req)
 }
 
 // Get default Api.
@@ -0,0 +1,278 @@
+package dify
+
+import (
+	"iter"
+	"net/http"
+	"os"
+
+	"github.com/curtisnewbie/miso/miso"
+)
+
+// Api scoped to a named dify app, the api key is resolved from [KeyRegistry] on each call.
+//
+// Use [Api.App] to create one.
+type AppApi struct {
+	api  Api
+	name string
+}
+
+// Api scoped to a named dify dataset, the api key is resolved from [KeyRegistry] on each call.
+//
+// Use [Api.Dataset] to create one.
+type DatasetApi struct {
+	api  Api
+	name string
+}
+
+// Create Api scoped to the named app configured in 'dify.apps.<name>'.
+func (a Api) App(name string) AppApi {
+	return AppApi{api: a, name: name}
+}
+
+// Create Api scoped to the named dataset configured in 'dify.datasets.<name>'.
+func (a Api) Dataset(name string) DatasetApi {
+	return DatasetApi{api: a, name: name}
+}
+
+func (a Api) withKeyEntry(e KeyEntry) Api {
+	a.scope = e.Name
+	if e.Host != "" {
+		host := e.Host
+		a.host = func() string { return host }
+		a.pool = nil
+	}
+	return a
+}
+
+func (a AppApi) resolve() (Api, string, error) {
+	e, err := GetKeyRegistry().App(a.name)
+	if err != nil {
+		return a.api, "", err
+	}
+	return a.api.withKeyEntry(e), e.ApiKey, nil
+}
+
+func (a DatasetApi) resolve() (Api, string, error) {
+	e, err := GetKeyRegistry().Dataset(a.name)
+	if err != nil {
+		return a.api, "", err
+	}
+	return a.api.withKeyEntry(e), e.ApiKey, nil
+}
+
+func (a AppApi) StreamQueryChatBot(rail miso.Rail, req ChatMessageReq) (ChatMessageRes, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return ChatMessageRes{}, err
+	}
+	return api.StreamQueryChatBot(rail, key, req)
+}
+
+func (a AppApi) ProxyStreamQueryChatBot(rail miso.Rail, req ChatMessageReq, w http.ResponseWriter, r *http.Request, appendSseData ...func() string) (ChatMessageRes, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return ChatMessageRes{}, err
+	}
+	return api.ProxyStreamQueryChatBot(rail, key, req, w, r, appendSseData...)
+}
+
+func (a AppApi) ProxyChat(rail miso.Rail, req ChatMessageReq, w http.ResponseWriter, r *http.Request, opts ...func(c *ProxyConfig)) (ChatMessageRes, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return ChatMessageRes{}, err
+	}
+	return api.ProxyChat(rail, key, req, w, r, opts...)
+}
+
+func (a AppApi) ProxyWsChat(rail miso.Rail, w http.ResponseWriter, r *http.Request, prepare func(req *ChatMessageReq) error, opts ...func(c *ProxyConfig)) error {
+	api, key, err := a.resolve()
+	if err != nil {
+		return err
+	}
+	api.ProxyWsChat(rail, key, w, r, prepare, opts...)
+	return nil
+}
+
+func (a AppApi) StreamChat(rail miso.Rail, req ChatMessageReq) iter.Seq2[ChatStreamEvent, error] {
+	api, key, err := a.resolve()
+	if err != nil {
+		return func(yield func(ChatStreamEvent, error) bool) { yield(nil, err) }
+	}
+	return api.StreamChat(rail, key, req)
+}
+
+func (a AppApi) StopChatMessage(rail miso.Rail, req StopChatMessageReq) error {
+	api, key, err := a.resolve()
+	if err != nil {
+		return err
+	}
+	return api.StopChatMessage(rail, key, req)
+}
+
+func (a AppApi) GetConversationVar(rail miso.Rail, req GetConversationVarReq) (GetConversationVarRes, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return GetConversationVarRes{}, err
+	}
+	return api.GetConversationVar(rail, key, req)
+}
+
+func (a AppApi) SendMsgFeedback(rail miso.Rail, req MsgFeedbackReq) error {
+	api, key, err := a.resolve()
+	if err != nil {
+		return err
+	}
+	return api.SendMsgFeedback(rail, key, req)
+}
+
+func (a AppApi) RunWorkflow(rail miso.Rail, req WorkflowReq) (WorkflowRes, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return WorkflowRes{}, err
+	}
+	return api.RunWorkflow(rail, key, req)
+}
+
+func (a AppApi) UploadFile(rail miso.Rail, user string, file *os.File, filename string) (UploadFileRes, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return UploadFileRes{}, err
+	}
+	return api.UploadFile(rail, key, user, file, filename)
+}
+
+func (a DatasetApi) CreateDataset(rail miso.Rail, r CreateDatasetReq) (CreateDatasetRes, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return CreateDatasetRes{}, err
+	}
+	return api.CreateDataset(rail, key, r)
+}
+
+func (a DatasetApi) GetDocument(rail miso.Rail, req GetDocumentReq) (GetDocumentRes, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return GetDocumentRes{}, err
+	}
+	return api.GetDocument(rail, key, req)
+}
+
+func (a DatasetApi) AddDocumentSegment(rail miso.Rail, req AddDocumentSegmentReq) ([]AddDocumentSegmentRes, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return api.AddDocumentSegment(rail, key, req)
+}
+
+func (a DatasetApi) AddDocumentChildSegment(rail miso.Rail, req AddDocumentChildSegmentReq) (AddDocumentChildSegmentRes, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return AddDocumentChildSegmentRes{}, err
+	}
+	return api.AddDocumentChildSegment(rail, key, req)
+}
+
+func (a DatasetApi) BulkAddSegments(rail miso.Rail, req BulkAddSegmentsReq) (BulkAddSegmentsReport, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return BulkAddSegmentsReport{}, err
+	}
+	return api.BulkAddSegments(rail, key, req)
+}
+
+func (a DatasetApi) PushChunks(rail miso.Rail, req PushChunksReq) ([]AddDocumentSegmentRes, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return api.PushChunks(rail, key, req)
+}
+
+func (a DatasetApi) UploadDocument(rail miso.Rail, req UploadDocumentReq) (UploadDocumentRes, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return UploadDocumentRes{}, err
+	}
+	return api.UploadDocument(rail, key, req)
+}
+
+func (a DatasetApi) RemoveDocument(rail miso.Rail, req RemoveDocumentReq) error {
+	api, key, err := a.resolve()
+	if err != nil {
+		return err
+	}
+	return api.RemoveDocument(rail, key, req)
+}
+
+func (a DatasetApi) CreateDocument(rail miso.Rail, req CreateDocumentReq) (UploadDocumentRes, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return UploadDocumentRes{}, err
+	}
+	return api.CreateDocument(rail, key, req)
+}
+
+func (a DatasetApi) GetDocIndexingStatus(rail miso.Rail, req GetDocIndexingStatusReq) ([]DocIndexingStatus, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return api.GetDocIndexingStatus(rail, key, req)
+}
+
+func (a DatasetApi) UpdateDocMetadata(rail miso.Rail, datasetId string, req UpdateDocMetadataReq) error {
+	api, key, err := a.resolve()
+	if err != nil {
+		return err
+	}
+	return api.UpdateDocMetadata(rail, key, datasetId, req)
+}
+
+func (a DatasetApi) ListDatasetMetadata(rail miso.Rail, datasetId string) (ListDatasetMetadataRes, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return ListDatasetMetadataRes{}, err
+	}
+	return api.ListDatasetMetadata(rail, key, datasetId)
+}
+
+func (a DatasetApi) Retrieve(rail miso.Rail, datasetId string, req RetrieveReq) (RetrieveRes, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return RetrieveRes{}, err
+	}
+	return api.Retrieve(rail, key, datasetId, req)
+}
+
+func (a DatasetApi) BuildMetaFilter(rail miso.Rail, datasetId string, f MetaFilter) (MetadataFilteringConditions, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return MetadataFilteringConditions{}, err
+	}
+	return api.BuildMetaFilter(rail, key, datasetId, f)
+}
+
+func (a DatasetApi) FederatedRetrieve(rail miso.Rail, req FederatedRetrieveReq) (FederatedRetrieveRes, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return FederatedRetrieveRes{}, err
+	}
+	return api.FederatedRetrieve(rail, key, req)
+}
+
+func (a DatasetApi) ResolveCitations(rail miso.Rail, l []Citation) ([]Citation, error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return l, err
+	}
+	return api.ResolveCitations(rail, key, l), nil
+}
+
+func (a DatasetApi) ProxyCitations(rail miso.Rail, format string) (func(c *ProxyConfig), error) {
+	api, key, err := a.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return api.ProxyCitations(rail, key, format), nil
+}
@@ -0,0 +1,230 @@
+package dify
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/curtisnewbie/miso/errs"
+	"github.com/curtisnewbie/miso/miso"
+)
+
+const (
+	BreakerClosed   = "CLOSED"    // requests are allowed
+	BreakerOpen     = "OPEN"      // requests fail fast
+	BreakerHalfOpen = "HALF_OPEN" // limited number of probe requests are allowed
+)
+
+var (
+	ErrCircuitOpen = errs.NewErrfCode("DIFY_CIRCUIT_OPEN", "dify is unavailable, circuit breaker is open")
+)
+
+// Circuit breaker config.
+type BreakerConfig struct {
+	ConsecutiveFailures int           // open the breaker after n consecutive failures, by default 5, -1 to disable
+	ErrorRate           float64       // open the breaker when error rate in Window reaches the threshold, e.g., 0.5, by default 0.5, -1 to disable
+	MinRequests         int           // min number of requests in Window before ErrorRate is checked, by default 20
+	Window              time.Duration // window of ErrorRate, by default 1m
+	OpenTimeout         time.Duration // how long the breaker stays open before probing, by default 30s
+	HalfOpenProbes      int           // number of successful probes required to close the breaker, by default 1
+}
+
+func (c BreakerConfig) withDefaults() BreakerConfig {
+	if c.ConsecutiveFailures == 0 {
+		c.ConsecutiveFailures = 5
+	}
+	if c.ErrorRate == 0 {
+		c.ErrorRate = 0.5
+	}
+	if c.MinRequests < 1 {
+		c.MinRequests = 20
+	}
+	if c.Window <= 0 {
+		c.Window = time.Minute
+	}
+	if c.OpenTimeout <= 0 {
+		c.OpenTimeout = 30 * time.Second
+	}
+	if c.HalfOpenProbes < 1 {
+		c.HalfOpenProbes = 1
+	}
+	return c
+}
+
+// Circuit breaker around dify host.
+//
+// Connection errors and 5xx responses are treated as failures, cancelled requests are ignored.
+//
+// Use [NewCircuitBreaker] to create one.
+type CircuitBreaker struct {
+	conf BreakerConfig
+
+	mu          sync.Mutex
+	state       string
+	openedAt    time.Time
+	consecutive int
+	windowStart time.Time
+	total       int
+	failed      int
+	probing     int
+	probed      int
+	gen         uint64 // incremented on each state change, requests admitted in previous states are not counted
+}
+
+// Admission of a request, returned by allow and passed back to done or ignore.
+type breakerTicket struct {
+	gen   uint64
+	probe bool // the request is a half-open probe
+}
+
+func NewCircuitBreaker(conf BreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{conf: conf.withDefaults(), state: BreakerClosed, windowStart: time.Now()}
+}
+
+// Current state of the breaker, e.g., BreakerClosed, BreakerOpen or BreakerHalfOpen.
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.conf.OpenTimeout {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// Whether the breaker is closed, i.e., dify is not degraded.
+func (b *CircuitBreaker) Healthy() bool {
+	return b.State() == BreakerClosed
+}
+
+// Create miso.HealthIndicator that reports dify as unhealthy when the breaker is not closed.
+//
+//	miso.AddHealthIndicator(breaker.HealthIndicator("dify"))
+func (b *CircuitBreaker) HealthIndicator(name string) miso.HealthIndicator {
+	return miso.HealthIndicator{
+		Name:        name,
+		CheckHealth: func(rail miso.Rail) bool { return b.Healthy() },
+	}
+}
+
+// Close the breaker and reset the counters.
+func (b *CircuitBreaker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.toState(BreakerClosed, time.Now())
+}
+
+func (b *CircuitBreaker) allow() (breakerTicket, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.state == BreakerOpen {
+		if now.Sub(b.openedAt) < b.conf.OpenTimeout {
+			return breakerTicket{}, ErrCircuitOpen.New()
+		}
+		b.toState(BreakerHalfOpen, now)
+	}
+	t := breakerTicket{gen: b.gen}
+	if b.state == BreakerHalfOpen {
+		if b.probing+b.probed >= b.conf.HalfOpenProbes {
+			return breakerTicket{}, ErrCircuitOpen.New()
+		}
+		b.probing++
+		t.probe = true
+	}
+	return t, nil
+}
+
+func (b *CircuitBreaker) done(t breakerTicket, success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// the request was admitted before the latest state change, its result says nothing about the current state
+	if t.gen != b.gen {
+		return
+	}
+	now := time.Now()
+	if t.probe {
+		b.probing--
+		if !success {
+			b.toState(BreakerOpen, now)
+			return
+		}
+		b.probed++
+		if b.probed >= b.conf.HalfOpenProbes {
+			b.toState(BreakerClosed, now)
+		}
+		return
+	}
+	if b.state != BreakerClosed {
+		return
+	}
+
+	if now.Sub(b.windowStart) >= b.conf.Window {
+		b.windowStart, b.total, b.failed = now, 0, 0
+	}
+	b.total++
+	if success {
+		b.consecutive = 0
+		return
+	}
+	b.failed++
+	b.consecutive++
+
+	if b.conf.ConsecutiveFailures > 0 && b.consecutive >= b.conf.ConsecutiveFailures {
+		b.toState(BreakerOpen, now)
+	} else if b.conf.ErrorRate > 0 && b.total >= b.conf.MinRequests && float64(b.failed)/float64(b.total) >= b.conf.ErrorRate {
+		b.toState(BreakerOpen, now)
+	}
+}
+
+func (b *CircuitBreaker) ignore(t breakerTicket) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if t.probe && t.gen == b.gen {
+		b.probing--
+	}
+}
+
+func (b *CircuitBreaker) toState(state string, now time.Time) {
+	if b.state != state {
+		miso.Warnf("Dify circuit breaker state changed, %v -> %v", b.state, state)
+	}
+	b.state = state
+	b.gen++
+	b.openedAt = now
+	b.consecutive, b.probing, b.probed = 0, 0, 0
+	b.windowStart, b.total, b.failed = now, 0, 0
+}
+
+// Create Api that fails fast with ErrCircuitOpen when dify is unavailable.
+//
+// The breaker is shared by the returned Api and all Api derived from it.
+func (a Api) WithCircuitBreaker(b *CircuitBreaker) Api {
+	a.breaker = b
+	return a
+}
+
+// Circuit breaker of the Api, nil if it's not configured.
+func (a Api) CircuitBreaker() *CircuitBreaker {
+	return a.breaker
+}
+
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *CircuitBreaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ticket, err := t.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil && req.Context().Err() != nil {
+		t.breaker.ignore(ticket) // cancelled by caller, dify is not necessarily unavailable
+		return resp, err
+	}
+	t.breaker.done(ticket, err == nil && resp.StatusCode < 500)
+	return resp, err
+}
@@ -0,0 +1,220 @@
+package dify
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/curtisnewbie/miso/errs"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util/async"
+)
+
+type BulkSegment struct {
+	DocSegment
+	Children []string // child chunks attached to the added segment
+}
+
+type BulkAddSegmentsReq struct {
+	DatasetId  string `valid:"notEmpty"`
+	DocumentId string `valid:"trim"`
+	Segments   []BulkSegment
+
+	BatchSize    int           // number of segments in each request, by default 50
+	Parallel     int           // max number of batches running concurrently, by default 4
+	MaxRetry     int           // max number of retries for each batch or child chunk, by default 2, -1 to disable retry, see [BulkAddSegments]
+	RetryBackoff time.Duration // backoff between retries, doubled on each retry, by default 1s
+}
+
+type BulkAddSegmentsReport struct {
+	Added          []AddDocumentSegmentRes // added segments, in the same order as the requested segments that succeeded
+	FailedBatches  []BulkFailedBatch       // batches that failed, sorted by Offset
+	PartialBatches []BulkPartialBatch      // batches that are only partially added, sorted by Offset
+	FailedChilds   []BulkFailedChild       // sorted by SegmentOffset
+}
+
+// Check whether all segments and child chunks are added.
+func (b BulkAddSegmentsReport) Success() bool {
+	return len(b.FailedBatches) < 1 && len(b.PartialBatches) < 1 && len(b.FailedChilds) < 1
+}
+
+// Batch that dify added fewer segments than requested.
+//
+// The added segments can't be matched with the requested ones, so child chunks of the batch are not attached.
+// Sending the batch again creates duplicate segments, remove the Added segments first if necessary.
+type BulkPartialBatch struct {
+	Offset int                     // offset of the first segment of the batch in BulkAddSegmentsReq.Segments
+	Count  int                     // number of segments in the batch
+	Added  []AddDocumentSegmentRes // segments that are added
+}
+
+type BulkFailedBatch struct {
+	Offset int   // offset of the first segment of the batch in BulkAddSegmentsReq.Segments
+	Count  int   // number of segments in the batch
+	Err    error // last error
+}
+
+type BulkFailedChild struct {
+	SegmentOffset int    // offset of the parent segment in BulkAddSegmentsReq.Segments
+	SegmentId     string // id of the parent segment
+	Content       string
+	Err           error // last error
+}
+
+type bulkBatchResult struct {
+	offset int
+	added  []AddDocumentSegmentRes
+}
+
+// Add large number of segments to dify document.
+//
+// Segments are split into batches, each batch is added using [AddDocumentSegment] concurrently.
+// Failed batches or child chunks are retried with backoff, only when the request didn't reach dify (e.g., connection refused,
+// 429 or circuit breaker open), as adding segments is not idempotent. A batch that failed after the request is sent (e.g.,
+// timeout or 5xx) may still be added by dify, check the document before sending it again.
+//
+// Child chunks are attached to the parent segment once the batch is added.
+//
+// Error is only returned when the request is invalid, failed batches and child chunks are reported in BulkAddSegmentsReport.
+func BulkAddSegments(rail miso.Rail, host string, apiKey string, req BulkAddSegmentsReq) (BulkAddSegmentsReport, error) {
+	if req.DatasetId == "" {
+		return BulkAddSegmentsReport{}, errs.NewErrf("datasetId is empty")
+	}
+	if req.BatchSize < 1 {
+		req.BatchSize = 50
+	}
+	if req.Parallel < 1 {
+		req.Parallel = 4
+	}
+	if req.MaxRetry == 0 {
+		req.MaxRetry = 2
+	} else if req.MaxRetry < 0 {
+		req.MaxRetry = 0
+	}
+	if req.RetryBackoff <= 0 {
+		req.RetryBackoff = time.Second
+	}
+
+	var (
+		report BulkAddSegmentsReport
+		mu     sync.Mutex
+	)
+	if len(req.Segments) < 1 {
+		return report, nil
+	}
+
+	pool := async.NewAsyncPool(req.Parallel)
+	defer pool.StopAndWait()
+
+	start := time.Now()
+	aw := async.NewAwaitFutures[bulkBatchResult](pool)
+	for offset := 0; offset < len(req.Segments); offset += req.BatchSize {
+		batch := req.Segments[offset:min(offset+req.BatchSize, len(req.Segments))]
+		aw.SubmitAsync(func() (bulkBatchResult, error) {
+			segments := make([]DocSegment, 0, len(batch))
+			for _, s := range batch {
+				segments = append(segments, s.DocSegment)
+			}
+
+			added, err := bulkRetry(rail, req.MaxRetry, req.RetryBackoff, func() ([]AddDocumentSegmentRes, error) {
+				return AddDocumentSegment(rail, host, apiKey, AddDocumentSegmentReq{
+					DatasetId:  req.DatasetId,
+					DocumentId: req.DocumentId,
+					Segments:   segments,
+				})
+			})
+			if err == nil && len(added) != len(batch) {
+				rail.Errorf("Segments batch partially added, offset: %v, count: %v, added: %v", offset, len(batch), len(added))
+				mu.Lock()
+				report.PartialBatches = append(report.PartialBatches, BulkPartialBatch{Offset: offset, Count: len(batch), Added: added})
+				mu.Unlock()
+				return bulkBatchResult{offset: offset}, errs.NewErrf("expected %v segments added, but got %v", len(batch), len(added))
+			}
+			if err != nil {
+				rail.Errorf("Failed to add segments batch, offset: %v, count: %v, %v", offset, len(batch), err)
+				mu.Lock()
+				report.FailedBatches = append(report.FailedBatches, BulkFailedBatch{Offset: offset, Count: len(batch), Err: err})
+				mu.Unlock()
+				return bulkBatchResult{offset: offset}, err
+			}
+
+			for i, s := range batch {
+				for _, child := range s.Children {
+					_, err := bulkRetry(rail, req.MaxRetry, req.RetryBackoff, func() (AddDocumentChildSegmentRes, error) {
+						return AddDocumentChildSegment(rail, host, apiKey, AddDocumentChildSegmentReq{
+							DatasetId:  req.DatasetId,
+							DocumentId: req.DocumentId,
+							SegmentId:  added[i].Id,
+							Content:    child,
+						})
+					})
+					if err != nil {
+						rail.Errorf("Failed to add child chunk, segmentId: %v, %v", added[i].Id, err)
+						mu.Lock()
+						report.FailedChilds = append(report.FailedChilds, BulkFailedChild{
+							SegmentOffset: offset + i,
+							SegmentId:     added[i].Id,
+							Content:       child,
+							Err:           err,
+						})
+						mu.Unlock()
+					}
+				}
+			}
+			return bulkBatchResult{offset: offset, added: added}, nil
+		})
+	}
+
+	// futures are in the same order as the batches
+	for _, f := range aw.Await() {
+		if r, err := f.Get(); err == nil {
+			report.Added = append(report.Added, r.added...)
+		}
+	}
+
+	slices.SortFunc(report.FailedBatches, func(a, b BulkFailedBatch) int { return a.Offset - b.Offset })
+	slices.SortFunc(report.PartialBatches, func(a, b BulkPartialBatch) int { return a.Offset - b.Offset })
+	slices.SortStableFunc(report.FailedChilds, func(a, b BulkFailedChild) int { return a.SegmentOffset - b.SegmentOffset })
+
+	rail.Infof("Bulk added dify document segments, documentId: %v, added: %v/%v, failed batches: %v, failed child chunks: %v, took: %v",
+		req.DocumentId, len(report.Added), len(req.Segments), len(report.FailedBatches), len(report.FailedChilds), time.Since(start))
+	return report, nil
+}
+
+// Retry f only if the request is known to be not processed by dify, since adding segments is not idempotent, e.g., retrying
+// after timeout or 5xx may create duplicate segments.
+func bulkRetry[T any](rail miso.Rail, maxRetry int, backoff time.Duration, f func() (T, error)) (T, error) {
+	var (
+		t   T
+		err error
+	)
+	for i := 0; i <= maxRetry; i++ {
+		if i > 0 {
+			select {
+			case <-rail.Done():
+				return t, errs.Wrapf(rail.Context().Err(), "context is closed, last error: %v", err)
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		t, err = f()
+		if err == nil || !bulkRetryable(err) {
+			return t, err
+		}
+	}
+	return t, err
+}
+
+// Whether err happens before the request reaches dify, i.e., failed to connect, rejected by rate limit or circuit breaker.
+func bulkRetryable(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrTooManyRequests) {
+		return true
+	}
+	var he miso.HttpError
+	if errors.As(err, &he) && he.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return isDialError(err)
+}
@@ -33,6 +33,7 @@ const (
 var (
 	ChatMessageUrl           = "/v1/chat-messages"
 	ConversationVariablesUrl = "/v1/conversations/%v/variables"
+	StopChatMessageUrl       = "/v1/chat-messages/%v/stop"
 )
 
 type SseEvent struct {
@@ -98,6 +99,7 @@ type ChatMessageRes struct {
 	Thought            string              `json:"thought"`
 	ErrorMsg           string              `json:"-"`
 	RetrieverResources []RetrieverResource `json:"-"`
+	Resumed            bool                `json:"-"` // the stream is resumed from [StreamBuffer], i.e., it's not a new chat
 }
 
 type ChatMessageEvent struct {
@@ -107,6 +109,7 @@ type ChatMessageEvent struct {
 	MessageId      string `json:"message_id"`
 	Answer         string `json:"answer"`
 	ConversationId string `json:"conversation_id"`
+	WorkflowRunId  string `json:"workflow_run_id,omitempty"`
 	Code           string `json:"code"`
 	Status         int    `json:"status"`
 	Message        string `json:"message"`
@@ -114,49 +117,45 @@ type ChatMessageEvent struct {
 		Outputs struct {
 			Answer string `json:"answer"`
 		} `json:"outputs"`
+		NodeId   string `json:"node_id,omitempty"`   // node_started, node_finished
+		NodeType string `json:"node_type,omitempty"` // node_started, node_finished
+		Title    string `json:"title,omitempty"`     // node_started, node_finished
+		Status   string `json:"status,omitempty"`    // node_finished, workflow_finished
 	} `json:"data"`
 	Metadata struct {
 		RetrieverResources []RetrieverResource `json:"retriever_resources"`
+		Usage              *Usage              `json:"usage,omitempty"`
 	}
 }
 
+// Model usage in message_end event.
+type Usage struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	TotalPrice       string  `json:"total_price"`
+	Currency         string  `json:"currency"`
+	Latency          float64 `json:"latency"`
+}
+
 type RetrieverResource struct {
-	Position    int     `json:"position"`
-	DatasetId   string  `json:"dataset_id"`
-	DatasetName string  `json:"dataset_name"`
-	DocumentId  string  `json:"document_id"`
-	SegmentId   string  `json:"segment_id"`
-	Score       float64 `json:"score"`
-	Content     string  `json:"content"`
+	Position     int     `json:"position"`
+	DatasetId    string  `json:"dataset_id"`
+	DatasetName  string  `json:"dataset_name"`
+	DocumentId   string  `json:"document_id"`
+	DocumentName string  `json:"document_name"`
+	SegmentId    string  `json:"segment_id"`
+	Score        float64 `json:"score"`
+	Content      string  `json:"content"`
 }
 
 func StreamQueryChatBot(rail miso.Rail, host string, apiKey string, req ChatMessageReq) (ChatMessageRes, error) {
 	url := host + ChatMessageUrl
-	newClient := func() *miso.TClient { return miso.NewClient(rail, url) }
-	return ApiStreamQueryChatBot(rail, newClient, apiKey, req)
+	return ApiStreamQueryChatBot(rail, func() *miso.TClient { return newClient(rail, url) }, apiKey, req)
 }
 
 func ApiStreamQueryChatBot(rail miso.Rail, newClient func() *miso.TClient, apiKey string, req any) (ChatMessageRes, error) {
-	if cr, ok := req.(ChatMessageReq); ok {
-		for i, f := range cr.Files {
-			if f.UploadFileId != "" {
-				f.TransferMethod = TransferMethodLocalFile
-			} else if f.Url != "" {
-				f.TransferMethod = TransferMethodRemoteUrl
-			}
-			cr.Files[i] = f
-		}
-		cr.ResponseMode = "streaming"
-
-		if cr.User == "" {
-			if appName := miso.GetPropStr(miso.PropAppName); appName != "" {
-				cr.User = appName
-			} else {
-				cr.User = "miso-dify-client"
-			}
-		}
-		req = cr
-	}
+	req = prepareChatReq(req)
 
 	var onSse func(e SseEvent) error = nil
 	if n, ok := req.(withOnSseEvent); ok {
@@ -173,7 +172,14 @@ func ApiStreamQueryChatBot(rail miso.Rail, newClient func() *miso.TClient, apiKe
 		chatMessageEventRewrite = n.getChatMessageEventRewrite()
 	}
 
-	var res ChatMessageRes
+	var (
+		res     ChatMessageRes
+		errCode string
+		difyErr *DifyError
+	)
+	sm := startStreamMetrics(rail, "StreamQueryChatBot")
+	rail, span := startStreamSpan(rail, "StreamQueryChatBot")
+	defer span.End()
 	err := newClient().
 		Require2xx().
 		AddAuthBearer(apiKey).
@@ -194,6 +200,8 @@ func ApiStreamQueryChatBot(rail miso.Rail, newClient func() *miso.TClient, apiKe
 			if err := json.SParseJson(e.Data, &cme); err != nil {
 				return true, errs.Wrapf(err, "parse streaming event failed, %v", e.Data)
 			}
+			sm.event(cme.Event, cme.Code, cme.Status)
+			span.event(cme)
 
 			if chatMessageEventRewrite != nil {
 				c, skip := chatMessageEventRewrite(cme)
@@ -241,6 +249,10 @@ func ApiStreamQueryChatBot(rail miso.Rail, newClient func() *miso.TClient, apiKe
 				}
 			case EventTypeError:
 				res.ErrorMsg += fmt.Sprintf("%v %v, %v", cme.Code, cme.Status, cme.Message)
+				errCode = cme.Code
+				if difyErr == nil {
+					difyErr = &DifyError{Code: cme.Code, Message: cme.Message, Status: cme.Status}
+				}
 			case EventTypeMessageEnd:
 				res.RetrieverResources = append(res.RetrieverResources, cme.Metadata.RetrieverResources...)
 			case EventTypeRewriteMessageId:
@@ -251,40 +263,55 @@ func ApiStreamQueryChatBot(rail miso.Rail, newClient func() *miso.TClient, apiKe
 			return false, nil
 		}, func(c *miso.SseReadConfig) { c.MaxEventSize = 512 * 1024 })
 
+	if err != nil && errCode == "" {
+		errCode = "stream_error"
+	}
+	sm.end(errCode)
 	if err != nil {
-		return ChatMessageRes{}, errs.Wrapf(err, "ApiStreamQueryChatBot failed")
+		span.RecordError(err)
+		return ChatMessageRes{}, wrapDifyErr(err, "ApiStreamQueryChatBot failed")
 	}
 
 	rail.Debugf("ApiStreamQueryChatBot, %#v", res)
-	if res.ErrorMsg != "" {
-		return ChatMessageRes{}, errs.NewErrf("ApiStreamQueryChatBot failed, %v", res.ErrorMsg)
+	if difyErr != nil {
+		span.RecordError(difyErr)
+		return ChatMessageRes{}, difyErr.MisoErr().Wrapf(difyErr, "ApiStreamQueryChatBot failed")
 	}
 	return res, nil
 }
 
-func ProxyStreamQueryChatBot(rail miso.Rail, host string, apiKey string, req ChatMessageReq, w http.ResponseWriter, r *http.Request, appendSseData ...func() string) (ChatMessageRes, error) {
-	sess, err := sse.Upgrade(w, r)
-	if err != nil {
-		return ChatMessageRes{}, err
+// Fill default values of ChatMessageReq, e.g., response_mode, user and file transfer_method.
+func prepareChatReq(req any) any {
+	cr, ok := req.(ChatMessageReq)
+	if !ok {
+		return req
 	}
-	req.OnSseEvent = func(e SseEvent) error {
-		// proxy the sse events to downstream
-		m := &sse.Message{}
-		m.AppendData(e.Data)
-		if err := sess.Send(m); err != nil {
-			rail.Warnf("Failed to proxy sse event, %v", err)
+	for i, f := range cr.Files {
+		if f.UploadFileId != "" {
+			f.TransferMethod = TransferMethodLocalFile
+		} else if f.Url != "" {
+			f.TransferMethod = TransferMethodRemoteUrl
 		}
-		return nil
+		cr.Files[i] = f
 	}
-	res, err := StreamQueryChatBot(rail, host, apiKey, req)
-	for _, ext := range appendSseData {
-		m := &sse.Message{}
-		m.AppendData(ext())
-		if err := sess.Send(m); err != nil {
-			rail.Warnf("Failed to append sse event, %v", err)
+	cr.ResponseMode = "streaming"
+
+	if cr.User == "" {
+		if appName := miso.GetPropStr(miso.PropAppName); appName != "" {
+			cr.User = appName
+		} else {
+			cr.User = "miso-dify-client"
 		}
 	}
-	return res, err
+	return cr
+}
+
+func ProxyStreamQueryChatBot(rail miso.Rail, host string, apiKey string, req ChatMessageReq, w http.ResponseWriter, r *http.Request, appendSseData ...func() string) (ChatMessageRes, error) {
+	return ProxyChat(rail, host, apiKey, req, w, r, func(c *ProxyConfig) {
+		for _, f := range appendSseData {
+			c.AppendSseEvents = append(c.AppendSseEvents, func() SseEvent { return SseEvent{Data: f()} })
+		}
+	})
 }
 
 type GetConversationVarRes struct {
@@ -312,7 +339,7 @@ type GetConversationVarReq struct {
 func GetConversationVar(rail miso.Rail, host string, apiKey string, req GetConversationVarReq) (GetConversationVarRes, error) {
 	url := fmt.Sprintf(host+ConversationVariablesUrl, req.ConversationId)
 	var res GetConversationVarRes
-	c := miso.NewClient(rail, url).
+	c := newClient(rail, url).
 		Require2xx().
 		AddAuthBearer(apiKey).
 		AddQuery("user", req.User)
@@ -323,5 +350,22 @@ func GetConversationVar(rail miso.Rail, host string, apiKey string, req GetConve
 	if req.Limit != nil {
 		c = c.AddQuery("limit", cast.ToString(*req.Limit))
 	}
-	return res, c.Get().Json(&res)
+	err := c.Get().Json(&res)
+	return res, wrapDifyErr(err, "dify.GetConversationVar failed")
+}
+
+type StopChatMessageReq struct {
+	TaskId string `json:"-"`
+	User   string `json:"user"`
+}
+
+// Stop a streaming chat message, the task id is available in the stream events.
+func StopChatMessage(rail miso.Rail, host string, apiKey string, req StopChatMessageReq) error {
+	url := host + fmt.Sprintf(StopChatMessageUrl, req.TaskId)
+	err := newClient(rail, url).
+		Require2xx().
+		AddAuthBearer(apiKey).
+		PostJson(req).
+		Ok()
+	return wrapDifyErr(err, "dify.StopChatMessage failed, taskId: %v", req.TaskId)
 }
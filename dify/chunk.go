@@ -0,0 +1,352 @@
+package dify
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/curtisnewbie/miso/errs"
+	"github.com/curtisnewbie/miso/miso"
+)
+
+const (
+	ProcessRuleModeAutomatic    = "automatic"
+	ProcessRuleModeCustom       = "custom"
+	ProcessRuleModeHierarchical = "hierarchical"
+
+	ParentModeFullDoc   = "full-doc"
+	ParentModeParagraph = "paragraph"
+
+	PreProcessingRemoveExtraSpaces = "remove_extra_spaces"
+	PreProcessingRemoveUrlsEmails  = "remove_urls_emails"
+)
+
+var (
+	// Separators used by dify to further split chunks that are still longer than max_tokens.
+	ChunkRecursiveSeparators = []string{"\n\n", "。", ". ", " ", ""}
+
+	// Max tokens allowed for a single segment, same as dify's default INDEXING_MAX_SEGMENTATION_TOKENS_LENGTH.
+	ChunkMaxTokensLimit = 4000
+)
+
+var (
+	invalidSymbolRe  = regexp.MustCompile(`[\x00-\x08\x0B\x0C\x0E-\x1F\x7F\x{FFFE}]`)
+	extraNewlinesRe  = regexp.MustCompile(`\n{3,}`)
+	extraSpacesRe    = regexp.MustCompile(`[\t\f\r\x20\x{3000}\x{2000}-\x{200A}\x{202F}\x{205F}]{2,}`)
+	emailRe          = regexp.MustCompile(`([a-zA-Z0-9_.+-]+@[a-zA-Z0-9-]+\.[a-zA-Z0-9-.]+)`)
+	urlRe            = regexp.MustCompile(`https?://[^\s]+`)
+	markdownImgUrlRe = regexp.MustCompile(`!\[.*?\]\((https?://[^\s)]+)\)`)
+)
+
+type ChunkConfig struct {
+	// Count tokens of the text, by default it's the number of runes, which is usually larger than
+	// the number of tokens counted by the embedding model, so the previewed chunks may be smaller
+	// than the ones produced by dify.
+	TokenCounter func(s string) int
+}
+
+type PreviewChunk struct {
+	Content  string              `json:"content"`
+	Tokens   int                 `json:"tokens"`
+	Children []PreviewChildChunk `json:"children"` // only in hierarchical mode
+}
+
+type PreviewChildChunk struct {
+	Content string `json:"content"`
+	Tokens  int    `json:"tokens"`
+}
+
+// Split text locally the same way dify does with the given ProcessRule.
+//
+// In automatic and custom mode, the text is split into parent chunks only.
+//
+// In hierarchical mode, each parent chunk (or the whole doc in full-doc mode) is further split into child chunks.
+func PreviewChunks(text string, rule ProcessRule, options ...func(c *ChunkConfig)) ([]PreviewChunk, error) {
+	conf := &ChunkConfig{}
+	for _, op := range options {
+		op(conf)
+	}
+	if conf.TokenCounter == nil {
+		conf.TokenCounter = utf8.RuneCountInString
+	}
+
+	if rule.Mode == "" {
+		rule.Mode = ProcessRuleModeAutomatic
+	}
+	var p ProcessRuleParam
+	switch rule.Mode {
+	case ProcessRuleModeAutomatic:
+		p = ProcessRuleParam{
+			PreProcessingRules: []PreProcessingRulesParam{{Id: PreProcessingRemoveExtraSpaces, Enabled: true}},
+			Segmentation:       &SegmentationParam{Separator: "\n", MaxTokens: 500, ChunkOverlap: 50},
+		}
+	case ProcessRuleModeCustom, ProcessRuleModeHierarchical:
+		if rule.Rules == nil {
+			return nil, errs.NewErrf("process rule is required in %v mode", rule.Mode)
+		}
+		p = *rule.Rules
+	default:
+		return nil, errs.NewErrf("unknown process rule mode: %v", rule.Mode)
+	}
+
+	text = CleanChunkText(text, p.PreProcessingRules)
+
+	if rule.Mode != ProcessRuleModeHierarchical {
+		seg := SegmentationParam{Separator: "\n", MaxTokens: 500}
+		if p.Segmentation != nil {
+			seg = *p.Segmentation
+		}
+		if err := checkSegmentation(seg.MaxTokens, seg.ChunkOverlap); err != nil {
+			return nil, err
+		}
+		split := splitChunk(text, seg.Separator, seg.MaxTokens, seg.ChunkOverlap, conf.TokenCounter)
+		chunks := make([]PreviewChunk, 0, len(split))
+		for _, s := range split {
+			chunks = append(chunks, PreviewChunk{Content: s, Tokens: conf.TokenCounter(s)})
+		}
+		return chunks, nil
+	}
+
+	parentMode := ParentModeParagraph
+	if p.ParentMode != nil && *p.ParentMode != "" {
+		parentMode = *p.ParentMode
+	}
+	sub := SubchunkSegmentationParam{Separator: "\n", MaxTokens: 512}
+	if p.SubchunkSegmentation != nil {
+		sub = *p.SubchunkSegmentation
+	}
+	if err := checkSegmentation(sub.MaxTokens, sub.ChunkOverlap); err != nil {
+		return nil, err
+	}
+
+	var parents []string
+	switch parentMode {
+	case ParentModeFullDoc:
+		if strings.TrimSpace(text) != "" {
+			parents = []string{strings.TrimSpace(text)}
+		}
+	case ParentModeParagraph:
+		seg := SegmentationParam{Separator: "\n\n", MaxTokens: 1024}
+		if p.Segmentation != nil {
+			seg = *p.Segmentation
+		}
+		if err := checkSegmentation(seg.MaxTokens, seg.ChunkOverlap); err != nil {
+			return nil, err
+		}
+		parents = splitChunk(text, seg.Separator, seg.MaxTokens, seg.ChunkOverlap, conf.TokenCounter)
+	default:
+		return nil, errs.NewErrf("unknown parent mode: %v", parentMode)
+	}
+
+	chunks := make([]PreviewChunk, 0, len(parents))
+	for _, parent := range parents {
+		c := PreviewChunk{Content: parent, Tokens: conf.TokenCounter(parent)}
+		for _, child := range splitChunk(parent, sub.Separator, sub.MaxTokens, sub.ChunkOverlap, conf.TokenCounter) {
+			c.Children = append(c.Children, PreviewChildChunk{Content: child, Tokens: conf.TokenCounter(child)})
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks, nil
+}
+
+// Clean text with the pre-processing rules.
+//
+// Invalid symbols are always removed, the same as dify.
+func CleanChunkText(text string, rules []PreProcessingRulesParam) string {
+	text = strings.ReplaceAll(text, "<|", "<")
+	text = strings.ReplaceAll(text, "|>", ">")
+	text = invalidSymbolRe.ReplaceAllString(text, "")
+
+	for _, r := range rules {
+		if !r.Enabled {
+			continue
+		}
+		switch r.Id {
+		case PreProcessingRemoveExtraSpaces:
+			text = extraNewlinesRe.ReplaceAllString(text, "\n\n")
+			text = extraSpacesRe.ReplaceAllString(text, " ")
+		case PreProcessingRemoveUrlsEmails:
+			text = emailRe.ReplaceAllString(text, "")
+
+			// keep urls of markdown images
+			var imgUrls []string
+			text = markdownImgUrlRe.ReplaceAllStringFunc(text, func(s string) string {
+				imgUrls = append(imgUrls, s)
+				return "\x00" // invalid symbols are already removed, safe to use as placeholder
+			})
+			text = urlRe.ReplaceAllString(text, "")
+			for _, u := range imgUrls {
+				text = strings.Replace(text, "\x00", u, 1)
+			}
+		}
+	}
+	return text
+}
+
+func checkSegmentation(maxTokens int, chunkOverlap int) error {
+	if maxTokens < 50 || maxTokens > ChunkMaxTokensLimit {
+		return errs.NewErrf("max_tokens should be between 50 and %v, but got %v", ChunkMaxTokensLimit, maxTokens)
+	}
+	if chunkOverlap < 0 || chunkOverlap > maxTokens {
+		return errs.NewErrf("chunk_overlap should be between 0 and max_tokens (%v), but got %v", maxTokens, chunkOverlap)
+	}
+	return nil
+}
+
+// Split by the fixed separator first, chunks that are still too large are split recursively.
+func splitChunk(text string, separator string, maxTokens int, overlap int, count func(string) int) []string {
+	separator = strings.ReplaceAll(separator, `\n`, "\n")
+
+	var split []string
+	if separator != "" {
+		split = strings.Split(text, separator)
+	} else {
+		split = []string{text}
+	}
+
+	chunks := make([]string, 0, len(split))
+	for _, s := range split {
+		if count(s) > maxTokens {
+			chunks = append(chunks, splitRecursive(s, ChunkRecursiveSeparators, maxTokens, overlap, count)...)
+		} else {
+			chunks = append(chunks, s)
+		}
+	}
+
+	nonEmpty := chunks[:0]
+	for _, c := range chunks {
+		if c = strings.TrimSpace(c); c != "" {
+			nonEmpty = append(nonEmpty, c)
+		}
+	}
+	return nonEmpty
+}
+
+func splitRecursive(text string, separators []string, maxTokens int, overlap int, count func(string) int) []string {
+	var sep string
+	var next []string
+	for i, s := range separators {
+		if s == "" || strings.Contains(text, s) {
+			sep = s
+			next = separators[i+1:]
+			break
+		}
+	}
+
+	var split []string
+	if sep == "" {
+		split = splitRunes(text)
+	} else {
+		split = strings.Split(text, sep)
+	}
+
+	var chunks, good []string
+	for _, s := range split {
+		if count(s) < maxTokens {
+			good = append(good, s)
+			continue
+		}
+		if len(good) > 0 {
+			chunks = append(chunks, mergeSplits(good, sep, maxTokens, overlap, count)...)
+			good = nil
+		}
+		if len(next) == 0 {
+			chunks = append(chunks, s)
+		} else {
+			chunks = append(chunks, splitRecursive(s, next, maxTokens, overlap, count)...)
+		}
+	}
+	if len(good) > 0 {
+		chunks = append(chunks, mergeSplits(good, sep, maxTokens, overlap, count)...)
+	}
+	return chunks
+}
+
+// Merge small splits into chunks of maxTokens with overlap, the same as langchain's TextSplitter._merge_splits.
+func mergeSplits(split []string, sep string, maxTokens int, overlap int, count func(string) int) []string {
+	sepLen := count(sep)
+	var chunks, curr []string
+	total := 0
+
+	sepLenIf := func(cond bool) int {
+		if cond {
+			return sepLen
+		}
+		return 0
+	}
+
+	for _, s := range split {
+		n := count(s)
+		if total+n+sepLenIf(len(curr) > 0) > maxTokens {
+			if len(curr) > 0 {
+				if c := strings.TrimSpace(strings.Join(curr, sep)); c != "" {
+					chunks = append(chunks, c)
+				}
+				for total > overlap || (total > 0 && total+n+sepLenIf(len(curr) > 0) > maxTokens) {
+					total -= count(curr[0]) + sepLenIf(len(curr) > 1)
+					curr = curr[1:]
+				}
+			}
+		}
+		curr = append(curr, s)
+		total += n + sepLenIf(len(curr) > 1)
+	}
+	if c := strings.TrimSpace(strings.Join(curr, sep)); c != "" {
+		chunks = append(chunks, c)
+	}
+	return chunks
+}
+
+func splitRunes(s string) []string {
+	split := make([]string, 0, len(s))
+	for _, r := range s {
+		split = append(split, string(r))
+	}
+	return split
+}
+
+type PushChunksReq struct {
+	DatasetId  string `valid:"notEmpty"`
+	DocumentId string `valid:"trim"`
+	Chunks     []PreviewChunk
+}
+
+// Push previewed chunks to dify document.
+//
+// Parent chunks are added using [AddDocumentSegment], and child chunks are then attached to the added parent
+// using [AddDocumentChildSegment].
+func PushChunks(rail miso.Rail, host string, apiKey string, req PushChunksReq) ([]AddDocumentSegmentRes, error) {
+	if len(req.Chunks) < 1 {
+		return nil, nil
+	}
+	segments := make([]DocSegment, 0, len(req.Chunks))
+	for _, c := range req.Chunks {
+		segments = append(segments, DocSegment{Content: c.Content})
+	}
+	added, err := AddDocumentSegment(rail, host, apiKey, AddDocumentSegmentReq{
+		DatasetId:  req.DatasetId,
+		DocumentId: req.DocumentId,
+		Segments:   segments,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(added) != len(req.Chunks) {
+		return added, errs.NewErrf("dify.PushChunks failed, expected %v segments added, but got %v", len(req.Chunks), len(added))
+	}
+
+	for i, c := range req.Chunks {
+		for _, child := range c.Children {
+			_, err := AddDocumentChildSegment(rail, host, apiKey, AddDocumentChildSegmentReq{
+				DatasetId:  req.DatasetId,
+				DocumentId: req.DocumentId,
+				SegmentId:  added[i].Id,
+				Content:    child.Content,
+			})
+			if err != nil {
+				return added, err
+			}
+		}
+	}
+	return added, nil
+}
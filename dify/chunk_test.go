@@ -0,0 +1,101 @@
+package dify
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPreviewChunks(t *testing.T) {
+	words := make([]string, 12)
+	for i := range words {
+		words[i] = fmt.Sprintf("word%02d", i+1)
+	}
+	wordText := strings.Join(words, " ") // 12 words of 6 runes, 83 runes in total
+
+	custom := func(sep string, maxTokens int, overlap int, pre ...string) ProcessRule {
+		p := &ProcessRuleParam{Segmentation: &SegmentationParam{Separator: sep, MaxTokens: maxTokens, ChunkOverlap: overlap}}
+		for _, id := range pre {
+			p.PreProcessingRules = append(p.PreProcessingRules, PreProcessingRulesParam{Id: id, Enabled: true})
+		}
+		return ProcessRule{Mode: ProcessRuleModeCustom, Rules: p}
+	}
+	hierarchical := func(parentMode string, subMaxTokens int) ProcessRule {
+		return ProcessRule{Mode: ProcessRuleModeHierarchical, Rules: &ProcessRuleParam{
+			Segmentation:         &SegmentationParam{Separator: "\n\n", MaxTokens: 100},
+			ParentMode:           &parentMode,
+			SubchunkSegmentation: &SubchunkSegmentationParam{Separator: "\n", MaxTokens: subMaxTokens},
+		}}
+	}
+	paragraphs := "p1 line1\np1 line2\n\n\np2 line1"
+
+	tests := []struct {
+		name     string
+		text     string
+		rule     ProcessRule
+		want     []string
+		children [][]string
+		err      string
+	}{
+		{name: "custom separator", text: "a###b###  ###c", rule: custom("###", 50, 0), want: []string{"a", "b", "c"}},
+		{name: "escaped separator", text: "p1\n\np2", rule: custom(`\n\n`, 50, 0), want: []string{"p1", "p2"}},
+		{name: "max tokens", text: wordText, rule: custom("\n", 50, 0),
+			want: []string{strings.Join(words[:7], " "), strings.Join(words[7:], " ")}},
+		{name: "chunk overlap", text: wordText, rule: custom("\n", 50, 14),
+			want: []string{strings.Join(words[:7], " "), strings.Join(words[5:], " ")}},
+		{name: "full-doc", text: paragraphs, rule: hierarchical(ParentModeFullDoc, 50),
+			want:     []string{paragraphs},
+			children: [][]string{{"p1 line1", "p1 line2", "p2 line1"}}},
+		{name: "paragraph", text: paragraphs, rule: hierarchical(ParentModeParagraph, 50),
+			want:     []string{"p1 line1\np1 line2", "p2 line1"},
+			children: [][]string{{"p1 line1", "p1 line2"}, {"p2 line1"}}},
+		{name: "remove extra spaces", text: "a \t  b\n\n\n\nc", rule: custom("###", 50, 0, PreProcessingRemoveExtraSpaces),
+			want: []string{"a b\n\nc"}},
+		{name: "keep extra spaces", text: "a  b\n\n\nc", rule: custom("###", 50, 0), want: []string{"a  b\n\n\nc"}},
+		{name: "remove urls and emails", text: "mail me@x.com see https://x.com/a ![img](https://x.com/i.png)",
+			rule: custom("###", 50, 0, PreProcessingRemoveUrlsEmails), want: []string{"mail  see  ![img](https://x.com/i.png)"}},
+		{name: "max tokens too small", text: "a", rule: custom("\n", 49, 0), err: "max_tokens should be between 50 and 4000, but got 49"},
+		{name: "max tokens too large", text: "a", rule: custom("\n", 4001, 0), err: "max_tokens should be between 50 and 4000, but got 4001"},
+		{name: "negative chunk overlap", text: "a", rule: custom("\n", 50, -1), err: "chunk_overlap should be between 0 and max_tokens (50), but got -1"},
+		{name: "chunk overlap too large", text: "a", rule: custom("\n", 50, 51), err: "chunk_overlap should be between 0 and max_tokens (50), but got 51"},
+		{name: "subchunk max tokens too small", text: "a", rule: hierarchical(ParentModeParagraph, 10), err: "max_tokens should be between 50 and 4000, but got 10"},
+		{name: "custom mode without rules", text: "a", rule: ProcessRule{Mode: ProcessRuleModeCustom}, err: "process rule is required in custom mode"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks, err := PreviewChunks(tt.text, tt.rule)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("want error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			var children [][]string
+			for _, c := range chunks {
+				got = append(got, c.Content)
+				if c.Tokens != len([]rune(c.Content)) {
+					t.Errorf("tokens of %q, want %v, got %v", c.Content, len([]rune(c.Content)), c.Tokens)
+				}
+				if tt.rule.Mode == ProcessRuleModeHierarchical {
+					var l []string
+					for _, cc := range c.Children {
+						l = append(l, cc.Content)
+					}
+					children = append(children, l)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("chunks, want %q, got %q", tt.want, got)
+			}
+			if !reflect.DeepEqual(children, tt.children) {
+				t.Errorf("children, want %q, got %q", tt.children, children)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package dify
+
+import (
+	"fmt"
+	"html"
+	"slices"
+	"strings"
+
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util/json"
+)
+
+// Formats of rendered citations.
+const (
+	CitationFormatMarkdown = "markdown"
+	CitationFormatHtml     = "html"
+	CitationFormatJson     = "json" // structured citations only, nothing is rendered
+
+	CitationEventType = "citations" // type of the SSE event created by [CitationsEvent]
+)
+
+// Citation of a document, i.e., a footnote.
+type Citation struct {
+	Number       int            `json:"number"` // footnote number, starts from 1
+	DatasetId    string         `json:"dataset_id"`
+	DatasetName  string         `json:"dataset_name"`
+	DocumentId   string         `json:"document_id"`
+	DocumentName string         `json:"document_name"`
+	DownloadUrl  string         `json:"download_url,omitempty"` // resolved by [ResolveCitations]
+	Score        float64        `json:"score"`                  // highest score of the segments
+	Segments     []CitedSegment `json:"segments"`
+}
+
+type CitedSegment struct {
+	SegmentId string  `json:"segment_id"`
+	Score     float64 `json:"score"`
+	Content   string  `json:"content"`
+}
+
+// Build citations from retriever_resources.
+//
+// Resources are grouped by document and deduped by segment. Footnote numbers are assigned in the order of the resources'
+// positions, so the same resources always produce the same numbers.
+func NewCitations(resources []RetrieverResource) []Citation {
+	sorted := slices.Clone(resources)
+	slices.SortStableFunc(sorted, func(a, b RetrieverResource) int { return a.Position - b.Position })
+
+	var l []Citation
+	idx := map[string]int{}
+	seen := map[string]bool{}
+	for _, r := range sorted {
+		docKey := r.DatasetId + "/" + r.DocumentId
+		if r.DocumentId == "" {
+			docKey = "segment/" + r.SegmentId
+		}
+		i, ok := idx[docKey]
+		if !ok {
+			i = len(l)
+			idx[docKey] = i
+			l = append(l, Citation{
+				Number:       i + 1,
+				DatasetId:    r.DatasetId,
+				DatasetName:  r.DatasetName,
+				DocumentId:   r.DocumentId,
+				DocumentName: r.DocumentName,
+			})
+		}
+		c := &l[i]
+		if r.Score > c.Score {
+			c.Score = r.Score
+		}
+		segKey := docKey + "/" + r.SegmentId
+		if r.SegmentId != "" && seen[segKey] {
+			continue
+		}
+		seen[segKey] = true
+		c.Segments = append(c.Segments, CitedSegment{SegmentId: r.SegmentId, Score: r.Score, Content: r.Content})
+	}
+	return l
+}
+
+// Resolve document names and download urls of the citations using GetDocument.
+//
+// apiKey is the dataset api key. Failures are logged and the citations are kept as is.
+func ResolveCitations(rail miso.Rail, host string, apiKey string, l []Citation) []Citation {
+	l = slices.Clone(l)
+	for i, c := range l {
+		if c.DatasetId == "" || c.DocumentId == "" {
+			continue
+		}
+		doc, err := GetDocument(rail, host, apiKey, GetDocumentReq{DatasetId: c.DatasetId, DocumentId: c.DocumentId})
+		if err != nil {
+			rail.Warnf("Failed to resolve cited document %v in dataset %v, %v", c.DocumentId, c.DatasetId, err)
+			continue
+		}
+		if doc.Name != "" {
+			l[i].DocumentName = doc.Name
+		}
+		l[i].DownloadUrl = doc.DownloadUrl
+	}
+	return l
+}
+
+func (c Citation) title() string {
+	if c.DocumentName != "" {
+		return c.DocumentName
+	}
+	if c.DocumentId != "" {
+		return c.DocumentId
+	}
+	return fmt.Sprintf("Source %v", c.Number)
+}
+
+// Render citations as Markdown, one footnote per line, e.g., '[1] [doc.pdf](url)'.
+func RenderCitationsMarkdown(l []Citation) string {
+	var b strings.Builder
+	for _, c := range l {
+		t := strings.NewReplacer("[", "\\[", "]", "\\]").Replace(c.title())
+		if c.DownloadUrl != "" {
+			fmt.Fprintf(&b, "[%v] [%v](%v)\n", c.Number, t, c.DownloadUrl)
+		} else {
+			fmt.Fprintf(&b, "[%v] %v\n", c.Number, t)
+		}
+	}
+	return b.String()
+}
+
+// Render citations as HTML ordered list, each item has id 'cite-<number>'.
+func RenderCitationsHtml(l []Citation) string {
+	if len(l) < 1 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(`<ol class="citations">`)
+	for _, c := range l {
+		t := html.EscapeString(c.title())
+		if c.DownloadUrl != "" {
+			fmt.Fprintf(&b, `<li id="cite-%v" value="%v"><a href="%v">%v</a></li>`, c.Number, c.Number, html.EscapeString(c.DownloadUrl), t)
+		} else {
+			fmt.Fprintf(&b, `<li id="cite-%v" value="%v">%v</li>`, c.Number, c.Number, t)
+		}
+	}
+	b.WriteString(`</ol>`)
+	return b.String()
+}
+
+type citationsEventData struct {
+	Event     string     `json:"event"`
+	Format    string     `json:"format"`
+	Content   string     `json:"content,omitempty"` // rendered citations
+	Citations []Citation `json:"citations"`
+}
+
+// Create SSE event of citations, e.g., to append it to the proxied stream.
+//
+// The data is '{"event": "citations", "format": "...", "content": "...", "citations": [...]}', where content is
+// rendered in the format unless format is [CitationFormatJson].
+func CitationsEvent(l []Citation, format string) SseEvent {
+	d := citationsEventData{Event: CitationEventType, Format: format, Citations: l}
+	if d.Citations == nil {
+		d.Citations = []Citation{}
+	}
+	switch format {
+	case CitationFormatMarkdown:
+		d.Content = RenderCitationsMarkdown(l)
+	case CitationFormatHtml:
+		d.Content = RenderCitationsHtml(l)
+	default:
+		d.Format = CitationFormatJson
+	}
+	return SseEvent{Type: CitationEventType, Data: json.TrySWriteJson(d)}
+}
+
+// Append citations event to the proxied stream, the retriever_resources are collected from the proxied events.
+//
+// host and apiKey (dataset api key) are used to resolve the cited documents, resolution is skipped if apiKey is empty.
+// The option adds a middleware, it should be applied after the options that replace [ProxyConfig].Middlewares.
+//
+// E.g.,
+//
+//	dify.ProxyChat(rail, host, appKey, req, w, r, dify.ProxyCitations(rail, host, datasetKey, dify.CitationFormatMarkdown))
+func ProxyCitations(rail miso.Rail, host string, apiKey string, format string) func(c *ProxyConfig) {
+	return func(c *ProxyConfig) {
+		var resources []RetrieverResource
+		collect := func(rail miso.Rail, e ProxyEvent, next func(e ProxyEvent) error) error {
+			if e.Event != nil {
+				resources = append(resources, e.Event.RawEvent().Metadata.RetrieverResources...)
+			}
+			return next(e)
+		}
+		c.Middlewares = append([]ProxyMiddleware{collect}, c.Middlewares...)
+		c.AppendSseEvents = append(c.AppendSseEvents, func() SseEvent {
+			l := NewCitations(resources)
+			if apiKey != "" {
+				l = ResolveCitations(rail, host, apiKey, l)
+			}
+			return CitationsEvent(l, format)
+		})
+	}
+}
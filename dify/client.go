@@ -0,0 +1,172 @@
+package dify
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/curtisnewbie/miso/miso"
+)
+
+const (
+	GroupChat         = "chat"          // chat messages, conversations and message feedbacks
+	GroupWorkflow     = "workflow"      // workflow runs
+	GroupFile         = "file"          // file uploads
+	GroupDatasetRead  = "dataset-read"  // dataset, document and metadata queries
+	GroupDatasetWrite = "dataset-write" // dataset, document, segment and metadata changes
+	GroupRetrieval    = "retrieval"     // dataset retrieval
+)
+
+const (
+	OpUnknown = "Unknown"
+)
+
+var (
+	operations = []struct {
+		method  string
+		pattern string
+		name    string
+	}{
+		{http.MethodPost, "/v1/chat-messages", "StreamQueryChatBot"},
+		{http.MethodPost, "/v1/chat-messages/*/stop", "StopChatMessage"},
+		{http.MethodGet, "/v1/conversations/*/variables", "GetConversationVar"},
+		{http.MethodPost, "/v1/messages/*/feedbacks", "SendMsgFeedback"},
+		{http.MethodPost, "/v1/workflows/run", "RunWorkflow"},
+		{http.MethodPost, "/v1/files/upload", "UploadFile"},
+		{http.MethodPost, "/v1/datasets", "CreateDataset"},
+		{http.MethodGet, "/v1/datasets/*/metadata", "ListDatasetMetadata"},
+		{http.MethodPost, "/v1/datasets/*/retrieve", "Retrieve"},
+		{http.MethodPost, "/v1/datasets/*/document/create-by-file", "UploadDocument"},
+		{http.MethodPost, "/v1/datasets/*/document/create-by-text", "CreateDocument"},
+		{http.MethodPost, "/v1/datasets/*/documents/metadata", "UpdateDocMetadata"},
+		{http.MethodGet, "/v1/datasets/*/documents/*/upload-file", "GetDocument"},
+		{http.MethodGet, "/v1/datasets/*/documents/*/indexing-status", "GetDocIndexingStatus"},
+		{http.MethodDelete, "/v1/datasets/*/documents/*", "RemoveDocument"},
+		{http.MethodPost, "/v1/datasets/*/documents/*/segments", "AddDocumentSegment"},
+		{http.MethodPost, "/v1/datasets/*/documents/*/segments/*/child_chunks", "AddDocumentChildSegment"},
+		{http.MethodGet, "/health", "Ping"},
+	}
+)
+
+var (
+	transportMu sync.RWMutex
+	transport   http.RoundTripper = nil // nil: use miso.MisoDefaultClient
+)
+
+type apiCtxKey struct{}
+
+// Change the http.RoundTripper used by every call in this package, e.g., to record and replay dify http interactions.
+//
+// Pass nil to use miso.MisoDefaultClient again.
+func SetTransport(rt http.RoundTripper) {
+	transportMu.Lock()
+	defer transportMu.Unlock()
+	transport = rt
+}
+
+// Get the http.RoundTripper used by every call in this package.
+func GetTransport() http.RoundTripper {
+	transportMu.RLock()
+	defer transportMu.RUnlock()
+	if transport != nil {
+		return transport
+	}
+	return miso.MisoDefaultClient.Transport
+}
+
+// Endpoint group of the dify api, e.g., GroupChat, GroupRetrieval.
+func EndpointGroup(method string, path string) string {
+	switch {
+	case strings.HasPrefix(path, "/v1/chat-messages"),
+		strings.HasPrefix(path, "/v1/conversations"),
+		strings.HasPrefix(path, "/v1/messages"):
+		return GroupChat
+	case strings.HasPrefix(path, "/v1/workflows"):
+		return GroupWorkflow
+	case strings.HasPrefix(path, "/v1/files"):
+		return GroupFile
+	case strings.HasPrefix(path, "/v1/datasets") && strings.HasSuffix(path, "/retrieve"):
+		return GroupRetrieval
+	case strings.HasPrefix(path, "/v1/datasets") && method == http.MethodGet:
+		return GroupDatasetRead
+	}
+	return GroupDatasetWrite
+}
+
+// Name of the dify api operation, e.g., StreamQueryChatBot, Retrieve, OpUnknown if the endpoint is not known.
+func Operation(method string, p string) string {
+	for _, op := range operations {
+		if op.method != method {
+			continue
+		}
+		if ok, _ := path.Match(op.pattern, p); ok {
+			return op.name
+		}
+	}
+	return OpUnknown
+}
+
+// Whether the dify api call can be safely repeated.
+func Idempotent(method string, path string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodDelete, http.MethodPut:
+		return true
+	}
+	return EndpointGroup(method, path) == GroupRetrieval
+}
+
+// Bind Api to rail, so that the http clients created for the rail apply the Api's policies.
+func (a Api) bind(rail miso.Rail) miso.Rail {
+	return miso.NewRail(context.WithValue(rail.Context(), apiCtxKey{}, a))
+}
+
+func (a Api) wrapTransport(rt http.RoundTripper) http.RoundTripper {
+	if a.pool != nil {
+		rt = &hostPoolTransport{next: rt, pool: a.pool}
+	}
+	if a.limiter != nil {
+		rt = &rateLimitTransport{next: rt, limiter: a.limiter}
+	}
+	if a.breaker != nil {
+		rt = &breakerTransport{next: rt, breaker: a.breaker}
+	}
+	if a.retry != nil {
+		rt = &retryTransport{next: rt, policy: *a.retry}
+	}
+	if a.timeout > 0 || a.streamTimeout > 0 {
+		rt = &timeoutTransport{next: rt, timeout: a.timeout, streamTimeout: a.streamTimeout}
+	}
+	return rt
+}
+
+func newClient(rail miso.Rail, url string) *miso.TClient {
+	c := miso.NewClient(rail, url)
+
+	transportMu.RLock()
+	rt := transport
+	transportMu.RUnlock()
+
+	a, bound := rail.Context().Value(apiCtxKey{}).(Api)
+	metrics, tracing := metricsEnabled(), tracingEnabled()
+	if rt == nil && !bound && !metrics && !tracing {
+		return c
+	}
+	if rt == nil && bound {
+		rt = a.base
+	}
+	if rt == nil {
+		rt = miso.MisoDefaultClient.Transport
+	}
+	if bound {
+		rt = a.wrapTransport(rt)
+	}
+	if tracing {
+		rt = &traceTransport{next: rt, app: a.scope}
+	}
+	if metrics {
+		rt = &metricsTransport{next: rt, app: a.scope}
+	}
+	return c.UseClient(&http.Client{Transport: rt, Timeout: miso.MisoDefaultClient.Timeout})
+}
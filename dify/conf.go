@@ -0,0 +1,360 @@
+package dify
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/curtisnewbie/miso/errs"
+	"github.com/curtisnewbie/miso/miso"
+)
+
+// misoconfig-section: Dify Configuration
+const (
+
+	// misoconfig-prop: configure default Api from properties on startup | true
+	PropEnabled = "dify.enabled"
+
+	// misoconfig-prop: dify host, e.g., http://localhost:5001
+	PropHost = "dify.host"
+
+	// misoconfig-prop: list of dify hosts for load balancing and failover ([]string)
+	PropHosts = "dify.hosts"
+
+	// misoconfig-prop: dify service name resolved using miso's service registry (e.g., consul)
+	PropService = "dify.service"
+
+	// misoconfig-prop: load balancing strategy of dify.hosts or dify.service, `round-robin` or `least-inflight` | round-robin
+	PropLbStrategy = "dify.lb-strategy"
+
+	// misoconfig-prop: interval of active health check of dify.hosts or dify.service, 0 to disable | 0
+	PropHealthCheckInterval = "dify.health-check-interval"
+
+	// misoconfig-prop: timeout of non-streaming requests, 0 means no timeout | 0
+	PropTimeout = "dify.timeout"
+
+	// misoconfig-prop: timeout of chat and workflow requests, 0 means no timeout | 0
+	PropStreamTimeout = "dify.stream-timeout"
+
+	// misoconfig-prop: http proxy url, e.g., http://proxy:3128
+	PropHttpProxy = "dify.http-proxy"
+
+	// misoconfig-prop: ping dify on startup, fail the bootstrap if dify is unavailable | false
+	PropPingOnStartup = "dify.ping-on-startup"
+
+	// misoconfig-prop: what to do when the downstream client of proxied chat stream disconnects, `continue` or `stop` | continue
+	PropProxyOnDisconnect = "dify.proxy.on-disconnect"
+
+	// misoconfig-prop: interval of SSE comments sent to downstream client to keep idle proxied stream alive, 0 to disable | 15s
+	PropProxyKeepAliveInterval = "dify.proxy.keep-alive-interval"
+
+	// misoconfig-prop: naming of downstream events of proxied chat stream, `upstream` (forward upstream event type as is) or `dify` (use the event field in dify's payload) | upstream
+	PropProxyEventNaming = "dify.proxy.event-naming"
+
+	// misoconfig-prop: buffer proxied chat streams, so that clients can reconnect with Last-Event-ID to resume the stream | false
+	PropProxyBufferEnabled = "dify.proxy.buffer.enabled"
+
+	// misoconfig-prop: how long the buffered chat stream is kept after it ends | 5m
+	PropProxyBufferTTL = "dify.proxy.buffer.ttl"
+
+	// misoconfig-prop: max number of buffered chat streams, the oldest ones are evicted first | 1000
+	PropProxyBufferMaxStreams = "dify.proxy.buffer.max-streams"
+
+	// misoconfig-prop: max number of events buffered for each chat stream, the oldest ones are dropped first | 10000
+	PropProxyBufferMaxEvents = "dify.proxy.buffer.max-events"
+
+	// misoconfig-prop: max lifetime of the buffered chat stream that has not ended, the dify stream is cancelled once it's evicted | 30m
+	PropProxyBufferMaxLifetime = "dify.proxy.buffer.max-lifetime"
+
+	// misoconfig-prop: enable in-memory cache of dataset retrieval | false
+	PropRetrieveCacheEnabled = "dify.retrieve-cache.enabled"
+
+	// misoconfig-prop: ttl of cached retrieval results | 5m
+	PropRetrieveCacheTTL = "dify.retrieve-cache.ttl"
+
+	// misoconfig-prop: max number of cached retrieval results in memory | 1000
+	PropRetrieveCacheSize = "dify.retrieve-cache.size"
+
+	// misoconfig-prop: enable retry | false
+	PropRetryEnabled = "dify.retry.enabled"
+
+	// misoconfig-prop: max number of attempts including the first one | 3
+	PropRetryMaxAttempts = "dify.retry.max-attempts"
+
+	// misoconfig-prop: backoff before the first retry | 500ms
+	PropRetryBackoff = "dify.retry.backoff"
+
+	// misoconfig-prop: max backoff | 10s
+	PropRetryMaxBackoff = "dify.retry.max-backoff"
+
+	// misoconfig-prop: also retry non-idempotent calls, e.g., chat | false
+	PropRetryNonIdempotent = "dify.retry.non-idempotent"
+
+	// misoconfig-prop: enable client-side rate limit | false
+	PropRateLimitEnabled = "dify.rate-limit.enabled"
+
+	// misoconfig-prop: default number of requests allowed per second for each api key and endpoint group | 0
+	PropRateLimitRate = "dify.rate-limit.rate"
+
+	// misoconfig-prop: default burst for each api key and endpoint group | 0
+	PropRateLimitBurst = "dify.rate-limit.burst"
+
+	// misoconfig-prop: rate limit of endpoint groups, e.g., dify.rate-limit.groups.chat.rate, dify.rate-limit.groups.chat.burst
+	PropRateLimitGroups = "dify.rate-limit.groups"
+
+	// misoconfig-prop: enable circuit breaker | false
+	PropBreakerEnabled = "dify.circuit-breaker.enabled"
+
+	// misoconfig-prop: open the breaker after n consecutive failures | 5
+	PropBreakerConsecutiveFailures = "dify.circuit-breaker.consecutive-failures"
+
+	// misoconfig-prop: open the breaker when error rate reaches the threshold | 0.5
+	PropBreakerErrorRate = "dify.circuit-breaker.error-rate"
+
+	// misoconfig-prop: how long the breaker stays open before probing | 30s
+	PropBreakerOpenTimeout = "dify.circuit-breaker.open-timeout"
+
+	// misoconfig-prop: enable prometheus metrics of dify calls | false
+	PropMetricsEnabled = "dify.metrics.enabled"
+
+	// misoconfig-prop: named dify apps, e.g., dify.apps.<name>.api-key, dify.apps.<name>.host
+	PropApps = "dify.apps"
+
+	// misoconfig-prop: named dify datasets (knowledge base), e.g., dify.datasets.<name>.api-key, dify.datasets.<name>.host
+	PropDatasets = "dify.datasets"
+)
+
+// misoconfig-default-start
+func init() {
+	miso.SetDefProp(PropEnabled, true)
+	miso.SetDefProp(PropLbStrategy, LbRoundRobin)
+	miso.SetDefProp(PropHealthCheckInterval, "0s")
+	miso.SetDefProp(PropTimeout, "0s")
+	miso.SetDefProp(PropStreamTimeout, "0s")
+	miso.SetDefProp(PropPingOnStartup, false)
+	miso.SetDefProp(PropProxyOnDisconnect, DisconnectContinue)
+	miso.SetDefProp(PropProxyKeepAliveInterval, "15s")
+	miso.SetDefProp(PropProxyEventNaming, EventNamingUpstream)
+	miso.SetDefProp(PropProxyBufferEnabled, false)
+	miso.SetDefProp(PropProxyBufferTTL, "5m")
+	miso.SetDefProp(PropProxyBufferMaxStreams, 1000)
+	miso.SetDefProp(PropProxyBufferMaxEvents, 10000)
+	miso.SetDefProp(PropProxyBufferMaxLifetime, "30m")
+	miso.SetDefProp(PropRetrieveCacheEnabled, false)
+	miso.SetDefProp(PropRetrieveCacheTTL, "5m")
+	miso.SetDefProp(PropRetrieveCacheSize, 1000)
+	miso.SetDefProp(PropRetryEnabled, false)
+	miso.SetDefProp(PropRetryMaxAttempts, 3)
+	miso.SetDefProp(PropRetryBackoff, "500ms")
+	miso.SetDefProp(PropRetryMaxBackoff, "10s")
+	miso.SetDefProp(PropRetryNonIdempotent, false)
+	miso.SetDefProp(PropRateLimitEnabled, false)
+	miso.SetDefProp(PropBreakerEnabled, false)
+	miso.SetDefProp(PropBreakerConsecutiveFailures, 5)
+	miso.SetDefProp(PropBreakerErrorRate, 0.5)
+	miso.SetDefProp(PropBreakerOpenTimeout, "30s")
+	miso.SetDefProp(PropMetricsEnabled, false)
+}
+
+// misoconfig-default-end
+
+func init() {
+	miso.RegisterBootstrapCallback(miso.ComponentBootstrap{
+		Name:      "Bootstrap Dify",
+		Bootstrap: difyBootstrap,
+		Condition: difyBootstrapCondition,
+		Order:     miso.BootstrapOrderDefault,
+	})
+}
+
+func difyBootstrapCondition(rail miso.Rail) (bool, error) {
+	return miso.GetPropBool(PropEnabled), nil
+}
+
+func difyBootstrap(rail miso.Rail) error {
+	a, ok, err := NewApiFromProp()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		rail.Debugf("Dify host not configured, default Api is not changed")
+		return nil
+	}
+	SetDefaultApi(a)
+
+	if a.breaker != nil {
+		miso.AddHealthIndicator(a.breaker.HealthIndicator("dify"))
+	}
+	if miso.GetPropBool(PropPingOnStartup) {
+		if err := a.Ping(rail); err != nil {
+			return err
+		}
+		rail.Infof("Dify is available")
+	}
+	return nil
+}
+
+// Create Api from miso properties, e.g., dify.host, dify.retry.enabled.
+//
+// Returns false if none of dify.host, dify.hosts and dify.service is configured, and error if more than one of them is configured.
+func NewApiFromProp() (Api, bool, error) {
+	var (
+		host    = strings.TrimSuffix(miso.GetPropStrTrimmed(PropHost), "/")
+		hosts   = miso.GetPropStrSlice(PropHosts)
+		service = miso.GetPropStrTrimmed(PropService)
+		a       Api
+	)
+
+	poolOpt := func(c *HostPoolConfig) {
+		c.Strategy = miso.GetPropStr(PropLbStrategy)
+		c.HealthCheckInterval = miso.GetPropDuration(PropHealthCheckInterval)
+	}
+	switch s := miso.GetPropStr(PropLbStrategy); s {
+	case LbRoundRobin, LbLeastInflight:
+	default:
+		return a, false, invalidProp(PropLbStrategy, s)
+	}
+	if miso.GetPropDuration(PropHealthCheckInterval) < 0 {
+		return a, false, invalidProp(PropHealthCheckInterval, miso.GetPropStr(PropHealthCheckInterval))
+	}
+
+	configured := 0
+	for _, ok := range []bool{host != "", len(hosts) > 0, service != ""} {
+		if ok {
+			configured++
+		}
+	}
+	if configured > 1 {
+		return a, false, errs.NewErrf("invalid dify config, only one of %v, %v and %v can be configured", PropHost, PropHosts, PropService)
+	}
+
+	// host pool is created after all the props are validated, since it may start health check in background
+	var newPool func() *HostPool
+	switch {
+	case host != "":
+		if err := validateHost(PropHost, host); err != nil {
+			return a, false, err
+		}
+		a = NewApi(func() string { return host })
+	case len(hosts) > 0:
+		for _, h := range hosts {
+			if err := validateHost(PropHosts, h); err != nil {
+				return a, false, err
+			}
+		}
+		a = NewApi(func() string { return hostPoolPlaceholder })
+		newPool = func() *HostPool { return NewHostPool(hosts, poolOpt) }
+	case service != "":
+		a = NewApi(func() string { return hostPoolPlaceholder })
+		newPool = func() *HostPool { return NewServiceHostPool(service, poolOpt) }
+	default:
+		return a, false, nil
+	}
+
+	timeout, streamTimeout := miso.GetPropDuration(PropTimeout), miso.GetPropDuration(PropStreamTimeout)
+	if timeout < 0 {
+		return a, false, invalidProp(PropTimeout, timeout)
+	}
+	if streamTimeout < 0 {
+		return a, false, invalidProp(PropStreamTimeout, streamTimeout)
+	}
+	a = a.WithTimeout(timeout, streamTimeout)
+
+	if proxy := miso.GetPropStrTrimmed(PropHttpProxy); proxy != "" {
+		var err error
+		if a, err = a.WithHttpProxy(proxy); err != nil {
+			return a, false, errs.Wrapf(err, "invalid dify config %v", PropHttpProxy)
+		}
+	}
+
+	if miso.GetPropBool(PropRetrieveCacheEnabled) {
+		if miso.GetPropInt(PropRetrieveCacheSize) < 1 {
+			return a, false, invalidProp(PropRetrieveCacheSize, miso.GetPropInt(PropRetrieveCacheSize))
+		}
+		if miso.GetPropDuration(PropRetrieveCacheTTL) <= 0 {
+			return a, false, invalidProp(PropRetrieveCacheTTL, miso.GetPropStr(PropRetrieveCacheTTL))
+		}
+		a = a.WithRetrieveCache(NewRetrieveCache(NewMemRetrieveCacheStore(0)))
+	}
+
+	if miso.GetPropBool(PropRetryEnabled) {
+		p := RetryPolicy{
+			MaxAttempts:        miso.GetPropInt(PropRetryMaxAttempts),
+			Backoff:            miso.GetPropDuration(PropRetryBackoff),
+			MaxBackoff:         miso.GetPropDuration(PropRetryMaxBackoff),
+			RetryNonIdempotent: miso.GetPropBool(PropRetryNonIdempotent),
+		}
+		if p.MaxAttempts < 1 {
+			return a, false, invalidProp(PropRetryMaxAttempts, p.MaxAttempts)
+		}
+		if p.Backoff <= 0 {
+			return a, false, invalidProp(PropRetryBackoff, p.Backoff)
+		}
+		if p.MaxBackoff < p.Backoff {
+			return a, false, invalidProp(PropRetryMaxBackoff, p.MaxBackoff)
+		}
+		a = a.WithRetry(p)
+	}
+
+	if miso.GetPropBool(PropRateLimitEnabled) {
+		p := RateLimitPolicy{
+			Default: RateLimit{Rate: miso.GetPropFloat(PropRateLimitRate), Burst: miso.GetPropInt(PropRateLimitBurst)},
+			Groups:  map[string]RateLimit{},
+		}
+		if p.Default.Rate < 0 {
+			return a, false, invalidProp(PropRateLimitRate, p.Default.Rate)
+		}
+		if p.Default.Burst < 0 {
+			return a, false, invalidProp(PropRateLimitBurst, p.Default.Burst)
+		}
+		for _, g := range miso.GetPropChild(PropRateLimitGroups) {
+			switch g {
+			case GroupChat, GroupWorkflow, GroupFile, GroupDatasetRead, GroupDatasetWrite, GroupRetrieval:
+			default:
+				return a, false, invalidProp(PropRateLimitGroups, g)
+			}
+			rateProp, burstProp := fmt.Sprintf("%v.%v.rate", PropRateLimitGroups, g), fmt.Sprintf("%v.%v.burst", PropRateLimitGroups, g)
+			rl := RateLimit{Rate: miso.GetPropFloat(rateProp), Burst: miso.GetPropInt(burstProp)}
+			if rl.Rate < 0 {
+				return a, false, invalidProp(rateProp, rl.Rate)
+			}
+			if rl.Burst < 0 {
+				return a, false, invalidProp(burstProp, rl.Burst)
+			}
+			p.Groups[g] = rl
+		}
+		a = a.WithRateLimit(p)
+	}
+
+	if miso.GetPropBool(PropBreakerEnabled) {
+		c := BreakerConfig{
+			ConsecutiveFailures: miso.GetPropInt(PropBreakerConsecutiveFailures),
+			ErrorRate:           miso.GetPropFloat(PropBreakerErrorRate),
+			OpenTimeout:         miso.GetPropDuration(PropBreakerOpenTimeout),
+		}
+		if c.ErrorRate > 1 {
+			return a, false, invalidProp(PropBreakerErrorRate, c.ErrorRate)
+		}
+		if c.OpenTimeout <= 0 {
+			return a, false, invalidProp(PropBreakerOpenTimeout, c.OpenTimeout)
+		}
+		a = a.WithCircuitBreaker(NewCircuitBreaker(c))
+	}
+
+	if newPool != nil {
+		a = a.WithHostPool(newPool())
+	}
+	return a, true, nil
+}
+
+func validateHost(prop string, host string) error {
+	u, err := url.Parse(host)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return invalidProp(prop, host)
+	}
+	return nil
+}
+
+func invalidProp(prop string, v any) error {
+	return errs.NewErrf("invalid dify config %v: '%v'", prop, v)
+}
@@ -1,7 +1,9 @@
 package dify
 
 import (
+	"cmp"
 	"fmt"
+	"slices"
 
 	"github.com/curtisnewbie/miso/miso"
 	"github.com/curtisnewbie/miso/util/atom"
@@ -106,12 +108,12 @@ type CreateDatasetRes struct {
 func CreateDataset(rail miso.Rail, host string, apiKey string, r CreateDatasetReq) (CreateDatasetRes, error) {
 	url := host + "/v1/datasets"
 	var res CreateDatasetRes
-	err := miso.NewClient(rail, url).
+	err := newClient(rail, url).
 		Require2xx().
 		AddAuthBearer(apiKey).
 		PostJson(r).
 		Json(&res)
-	return res, err
+	return res, wrapDifyErr(err, "dify.CreateDataset failed")
 }
 
 type ListedDatasetMetadata struct {
@@ -129,12 +131,12 @@ type ListDatasetMetadataRes struct {
 func ListDatasetMetadata(rail miso.Rail, host string, apiKey string, datasetId string) (ListDatasetMetadataRes, error) {
 	url := host + fmt.Sprintf("/v1/datasets/%v/metadata", datasetId)
 	var l ListDatasetMetadataRes
-	err := miso.NewClient(rail, url).
+	err := newClient(rail, url).
 		AddAuthBearer(apiKey).
 		Require2xx().
 		Get().
 		Json(&l)
-	return l, err
+	return l, wrapDifyErr(err, "dify.ListDatasetMetadata failed")
 }
 
 type MetadataFilteringCondition struct {
@@ -144,6 +146,7 @@ type MetadataFilteringCondition struct {
 	Value              string `json:"value"`
 }
 
+// Use [Meta] to build MetadataFilteringConditions with validation.
 type MetadataFilteringConditions struct {
 	Conditions      []MetadataFilteringCondition `json:"conditions"`
 	LogicalOperator string                       `json:"logical_operator"` // and | or
@@ -177,9 +180,17 @@ type RetrieveRes struct {
 }
 
 type RetrievedRecord struct {
-	Score        int64            `json:"score"`
-	Segment      RetrievedSegment `json:"segment"`
-	TsnePosition interface{}      `json:"tsne_position"`
+	Score        float64               `json:"score"` // relevance score, 0.0 - 1.0
+	Segment      RetrievedSegment      `json:"segment"`
+	ChildChunks  []RetrievedChildChunk `json:"child_chunks"` // matched child chunks of hierarchical (parent-child) datasets
+	TsnePosition interface{}           `json:"tsne_position"`
+}
+
+type RetrievedChildChunk struct {
+	ID       string  `json:"id"`
+	Content  string  `json:"content"`
+	Position int64   `json:"position"`
+	Score    float64 `json:"score"`
 }
 
 type RetrievedSegment struct {
@@ -191,9 +202,11 @@ type RetrievedSegment struct {
 	DisabledAt  *atom.Time `json:"disabled_at"`
 	DisabledBy  string     `json:"disabled_by"`
 	Document    struct {
-		DataSourceType string `json:"data_source_type"`
-		ID             string `json:"id"`
-		Name           string `json:"name"`
+		DataSourceType string         `json:"data_source_type"`
+		ID             string         `json:"id"`
+		Name           string         `json:"name"`
+		DocType        string         `json:"doc_type"`
+		DocMetadata    map[string]any `json:"doc_metadata"` // metadata name -> value
 	} `json:"document"`
 	DocumentID    string     `json:"document_id"`
 	Enabled       bool       `json:"enabled"`
@@ -211,13 +224,51 @@ type RetrievedSegment struct {
 	WordCount     int64      `json:"word_count"`
 }
 
+// Retrieve records from dataset, the records are cached if [RetrieveCache] is configured.
 func Retrieve(rail miso.Rail, host string, apiKey string, datasetId string, req RetrieveReq) (RetrieveRes, error) {
+	if c := retrieveCacheOf(rail); c != nil {
+		return c.retrieve(rail, apiKey, datasetId, req, func() (RetrieveRes, error) {
+			return doRetrieve(rail, host, apiKey, datasetId, req)
+		})
+	}
+	return doRetrieve(rail, host, apiKey, datasetId, req)
+}
+
+func doRetrieve(rail miso.Rail, host string, apiKey string, datasetId string, req RetrieveReq) (RetrieveRes, error) {
 	var r RetrieveRes
-	err := miso.NewClient(rail, host+fmt.Sprintf("/v1/datasets/%v/retrieve", datasetId)).
+	err := newClient(rail, host+fmt.Sprintf("/v1/datasets/%v/retrieve", datasetId)).
 		AddHeader("Content-Type", "application/json").
 		AddAuthBearer(apiKey).
 		Require2xx().
 		PostJson(req).
 		Json(&r)
-	return r, err
+	return r, wrapDifyErr(err, "dify.Retrieve failed")
+}
+
+// Merge records retrieved from several datasets (or several queries), e.g., [Retrieve] called in parallel.
+//
+// Records of the same segment are deduped, the one with the highest score is kept. The merged records are re-ranked
+// by score in descending order, records with the same score keep their original order. topK <= 0 means no limit.
+func MergeRetrievedRecords(topK int, records ...[]RetrievedRecord) []RetrievedRecord {
+	var merged []RetrievedRecord
+	idx := map[string]int{}
+	for _, l := range records {
+		for _, r := range l {
+			if r.Segment.ID != "" {
+				if i, ok := idx[r.Segment.ID]; ok {
+					if r.Score > merged[i].Score {
+						merged[i] = r
+					}
+					continue
+				}
+				idx[r.Segment.ID] = len(merged)
+			}
+			merged = append(merged, r)
+		}
+	}
+	slices.SortStableFunc(merged, func(a, b RetrievedRecord) int { return cmp.Compare(b.Score, a.Score) })
+	if topK > 0 && len(merged) > topK {
+		merged = merged[:topK]
+	}
+	return merged
 }
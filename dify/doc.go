@@ -38,7 +38,7 @@ type GetDocumentReq struct {
 func GetDocument(rail miso.Rail, host string, apiKey string, req GetDocumentReq) (GetDocumentRes, error) {
 	url := host + fmt.Sprintf("/v1/datasets/%v/documents/%v/upload-file", req.DatasetId, req.DocumentId)
 	var res GetDocumentRes
-	tr := miso.NewClient(rail, url).
+	tr := newClient(rail, url).
 		AddAuthBearer(apiKey).
 		Get()
 	if tr.StatusCode == 404 {
@@ -47,7 +47,7 @@ func GetDocument(rail miso.Rail, host string, apiKey string, req GetDocumentReq)
 
 	err := tr.Json(&res)
 	if err != nil {
-		return res, errs.Wrapf(err, "dify.GetDocument failed")
+		return res, wrapDifyErr(err, "dify.GetDocument failed")
 	}
 	return res, err
 }
@@ -70,8 +70,9 @@ type PreProcessingRulesParam struct {
 }
 
 type SegmentationParam struct {
-	Separator string `json:"separator"`
-	MaxTokens int    `json:"max_tokens"`
+	Separator    string `json:"separator"`
+	MaxTokens    int    `json:"max_tokens"`
+	ChunkOverlap int    `json:"chunk_overlap,omitempty"`
 }
 
 type SubchunkSegmentationParam struct {
@@ -137,15 +138,16 @@ func AddDocumentSegment(rail miso.Rail, host string, apiKey string, req AddDocum
 	url := host + fmt.Sprintf("/v1/datasets/%v/documents/%v/segments", req.DatasetId, req.DocumentId)
 
 	var res addDocumentSegmentApiRes
-	err := miso.NewClient(rail, url).
+	err := newClient(rail, url).
 		Require2xx().
 		AddAuthBearer(apiKey).
 		PostJson(addDocumentSegmentApiReq{Segments: req.Segments}).
 		Json(&res)
 	if err != nil {
-		return nil, errs.Wrapf(err, "dify.AddDocumentSegment failed, req: %#v", req)
+		return nil, wrapDifyErr(err, "dify.AddDocumentSegment failed, req: %#v", req)
 	}
 	rail.Infof("Added dify document segment, %#v", res)
+	invalidateRetrieveCache(rail, req.DatasetId)
 	return res.Data, nil
 }
 
@@ -175,15 +177,16 @@ func AddDocumentChildSegment(rail miso.Rail, host string, apiKey string, req Add
 	url := host + fmt.Sprintf("/v1/datasets/%v/documents/%v/segments/%v/child_chunks", req.DatasetId, req.DocumentId, req.SegmentId)
 
 	var res addDocumentChildSegmentApiRes
-	err := miso.NewClient(rail, url).
+	err := newClient(rail, url).
 		Require2xx().
 		AddAuthBearer(apiKey).
 		PostJson(addDocumentChildSegmentApiReq{Content: req.Content}).
 		Json(&res)
 	if err != nil {
-		return AddDocumentChildSegmentRes{}, errs.Wrapf(err, "dify.AddDocumentChildSegment failed, req: %#v", req)
+		return AddDocumentChildSegmentRes{}, wrapDifyErr(err, "dify.AddDocumentChildSegment failed, req: %#v", req)
 	}
 	rail.Infof("Added dify document child segment, %#v", res)
+	invalidateRetrieveCache(rail, req.DatasetId)
 	return res.Data, nil
 }
 
@@ -235,15 +238,16 @@ func UploadDocument(rail miso.Rail, host string, apiKey string, req UploadDocume
 	}
 
 	var res UploadDocumentRes
-	err = miso.NewClient(rail, url).
+	err = newClient(rail, url).
 		Require2xx().
 		AddAuthBearer(apiKey).
 		PostFormData(formData).
 		Json(&res)
 	if err != nil {
-		return res, errs.Wrapf(err, "dify.UploadDocument failed, req: %#v, apiReq: %#v", req, apiReq)
+		return res, wrapDifyErr(err, "dify.UploadDocument failed, req: %#v, apiReq: %#v", req, apiReq)
 	}
 	rail.Infof("Uploaded dify document, %v, %#v", req.FilePath, res)
+	invalidateRetrieveCache(rail, req.DatasetId)
 	return res, nil
 }
 
@@ -261,7 +265,7 @@ type RemoveDocumentRes struct {
 func RemoveDocument(rail miso.Rail, host string, apiKey string, req RemoveDocumentReq) error {
 	rail.Infof("Removing dify doc: %#v", req)
 	url := host + fmt.Sprintf("/v1/datasets/%v/documents/%v", req.DatasetId, req.DocumentId)
-	tr := miso.NewClient(rail, url).
+	tr := newClient(rail, url).
 		AddAuthBearer(apiKey).
 		Delete()
 	if tr.Err != nil {
@@ -269,6 +273,7 @@ func RemoveDocument(rail miso.Rail, host string, apiKey string, req RemoveDocume
 	}
 
 	if tr.StatusCode == 200 {
+		invalidateRetrieveCache(rail, req.DatasetId)
 		return nil
 	}
 
@@ -282,6 +287,9 @@ func RemoveDocument(rail miso.Rail, host string, apiKey string, req RemoveDocume
 		}
 	}
 
+	if de, ok := parseDifyError(tr.StatusCode, s); ok {
+		return de.MisoErr().Wrapf(de, "dify.RemoveDocument failed")
+	}
 	return errs.NewErrf("unknown error, status code: %v, body: %v", tr.StatusCode, s)
 }
 
@@ -344,15 +352,16 @@ func CreateDocument(rail miso.Rail, host string, apiKey string, req CreateDocume
 	}
 
 	var res UploadDocumentRes
-	err := miso.NewClient(rail, url).
+	err := newClient(rail, url).
 		Require2xx().
 		AddAuthBearer(apiKey).
 		PostJson(req).
 		Json(&res)
 	if err != nil {
-		return res, errs.Wrapf(err, "dify.CreateDocument failed, req: %#v, apiReq: %#v", req, apiReq)
+		return res, wrapDifyErr(err, "dify.CreateDocument failed, req: %#v, apiReq: %#v", req, apiReq)
 	}
 	rail.Infof("Created dify document, %v, %#v", req.Name, res)
+	invalidateRetrieveCache(rail, req.DatasetId)
 	return res, nil
 }
 
@@ -381,13 +390,13 @@ type GetDocIndexingStatusReq struct {
 func GetDocIndexingStatus(rail miso.Rail, host string, apiKey string, req GetDocIndexingStatusReq) ([]DocIndexingStatus, error) {
 	url := host + fmt.Sprintf("/v1/datasets/%v/documents/%v/indexing-status", req.DatasetId, req.BatchId)
 	var res GetDocIndexingStatusApiRes
-	err := miso.NewClient(rail, url).
+	err := newClient(rail, url).
 		Require2xx().
 		AddAuthBearer(apiKey).
 		Get().
 		Json(&res)
 	if err != nil {
-		return nil, errs.Wrapf(err, "dify.GetDocIndexingStatus failed, req: %#v", req)
+		return nil, wrapDifyErr(err, "dify.GetDocIndexingStatus failed, req: %#v", req)
 	}
 	return res.Data, nil
 }
@@ -409,10 +418,14 @@ type UpdateDocMetadataReq struct {
 
 func UpdateDocMetadata(rail miso.Rail, host string, apiKey string, datasetId string, req UpdateDocMetadataReq) error {
 	url := host + fmt.Sprintf("/v1/datasets/%v/documents/metadata", datasetId)
-	err := miso.NewClient(rail, url).
+	err := newClient(rail, url).
 		AddAuthBearer(apiKey).
 		Require2xx().
 		PostJson(req).
 		Ok()
-	return err
+	if err != nil {
+		return wrapDifyErr(err, "dify.UpdateDocMetadata failed")
+	}
+	invalidateRetrieveCache(rail, datasetId)
+	return nil
 }
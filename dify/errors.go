@@ -0,0 +1,150 @@
+package dify
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/curtisnewbie/miso/errs"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util/json"
+)
+
+// Error codes returned by dify, in error response body or SSE error event.
+const (
+	CodeInvalidParam           = "invalid_param"
+	CodeAppUnavailable         = "app_unavailable"
+	CodeProviderNotInitialize  = "provider_not_initialize"
+	CodeProviderQuotaExceeded  = "provider_quota_exceeded"
+	CodeModelNotSupport        = "model_currently_not_support"
+	CodeCompletionRequestError = "completion_request_error"
+	CodeNotFound               = "not_found"
+	CodeTooManyRequests        = "too_many_requests"
+	CodeUnauthorized           = "unauthorized"
+	CodeConversationCompleted  = "conversation_completed"
+	CodeWorkflowRequestError   = "workflow_request_error"
+	CodeFileTooLarge           = "file_too_large"
+	CodeUnsupportedFileType    = "unsupported_file_type"
+	CodeDatasetNameDuplicate   = "dataset_name_duplicate"
+	CodeDocumentIndexing       = "document_indexing"
+)
+
+// Errors mapped from dify error codes, use errors.Is to check them, e.g.,
+//
+//	if errors.Is(err, dify.ErrProviderQuotaExceeded) { ... }
+//
+// Use errors.As to get the *DifyError.
+var (
+	ErrInvalidParam          = errs.NewErrfCode("DIFY_INVALID_PARAM", "Invalid parameter")
+	ErrAppUnavailable        = errs.NewErrfCode("DIFY_APP_UNAVAILABLE", "AI app is unavailable, please try again later")
+	ErrProviderNotInitialize = errs.NewErrfCode("DIFY_PROVIDER_NOT_INITIALIZE", "AI model provider is not configured")
+	ErrProviderQuotaExceeded = errs.NewErrfCode("DIFY_PROVIDER_QUOTA_EXCEEDED", "AI model quota is exceeded, please try again later")
+	ErrModelNotSupport       = errs.NewErrfCode("DIFY_MODEL_NOT_SUPPORT", "AI model is currently not supported")
+	ErrCompletionRequest     = errs.NewErrfCode("DIFY_COMPLETION_REQUEST_ERROR", "AI model failed to respond, please try again later")
+	ErrNotFound              = errs.NewErrfCode("DIFY_NOT_FOUND", "Resource not found")
+	ErrTooManyRequests       = errs.NewErrfCode("DIFY_TOO_MANY_REQUESTS", "Too many requests, please try again later")
+	ErrUnauthorized          = errs.NewErrfCode("DIFY_UNAUTHORIZED", "Dify api key is invalid")
+	ErrConversationCompleted = errs.NewErrfCode("DIFY_CONVERSATION_COMPLETED", "Conversation is completed, please start a new one")
+	ErrWorkflowRequest       = errs.NewErrfCode("DIFY_WORKFLOW_REQUEST_ERROR", "Workflow failed, please try again later")
+	ErrFileTooLarge          = errs.NewErrfCode("DIFY_FILE_TOO_LARGE", "File is too large")
+	ErrUnsupportedFileType   = errs.NewErrfCode("DIFY_UNSUPPORTED_FILE_TYPE", "File type is not supported")
+	ErrDatasetNameDuplicate  = errs.NewErrfCode("DIFY_DATASET_NAME_DUPLICATE", "Dataset name already exists")
+	ErrDocumentIndexing      = errs.NewErrfCode("DIFY_DOCUMENT_INDEXING", "Document is being indexed, please try again later")
+	ErrDifyUnknown           = errs.NewErrfCode("DIFY_ERROR", "AI service is unavailable, please try again later")
+
+	codeErrs = map[string]*errs.MisoErr{
+		CodeInvalidParam:           ErrInvalidParam,
+		CodeAppUnavailable:         ErrAppUnavailable,
+		CodeProviderNotInitialize:  ErrProviderNotInitialize,
+		CodeProviderQuotaExceeded:  ErrProviderQuotaExceeded,
+		CodeModelNotSupport:        ErrModelNotSupport,
+		CodeCompletionRequestError: ErrCompletionRequest,
+		CodeNotFound:               ErrNotFound,
+		CodeTooManyRequests:        ErrTooManyRequests,
+		CodeUnauthorized:           ErrUnauthorized,
+		CodeConversationCompleted:  ErrConversationCompleted,
+		CodeWorkflowRequestError:   ErrWorkflowRequest,
+		CodeFileTooLarge:           ErrFileTooLarge,
+		CodeUnsupportedFileType:    ErrUnsupportedFileType,
+		CodeDatasetNameDuplicate:   ErrDatasetNameDuplicate,
+		CodeDocumentIndexing:       ErrDocumentIndexing,
+	}
+)
+
+// Error returned by dify, parsed from the error response body or the SSE error event.
+type DifyError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Status  int    `json:"status"`
+
+	cause error
+}
+
+func (e *DifyError) Error() string {
+	return fmt.Sprintf("dify error, status: %v, code: %v, message: %v", e.Status, e.Code, e.Message)
+}
+
+func (e *DifyError) Unwrap() error {
+	return e.cause
+}
+
+// Get the *errs.MisoErr that the dify error code is mapped to.
+//
+// Unknown codes are mapped by the http status, or [ErrDifyUnknown] if the status is not recognized either.
+func (e *DifyError) MisoErr() *errs.MisoErr {
+	if me, ok := codeErrs[e.Code]; ok {
+		return me
+	}
+	switch e.Status {
+	case http.StatusBadRequest:
+		return ErrInvalidParam
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusTooManyRequests:
+		return ErrTooManyRequests
+	}
+	return ErrDifyUnknown
+}
+
+// Implements errors.Is, the *DifyError matches the *errs.MisoErr it's mapped to.
+func (e *DifyError) Is(target error) bool {
+	me, ok := target.(*errs.MisoErr)
+	return ok && me.Code() == e.MisoErr().Code()
+}
+
+// Parse *DifyError from error response body.
+func parseDifyError(status int, body string) (*DifyError, bool) {
+	de := &DifyError{}
+	if err := json.SParseJson(body, de); err != nil || de.Code == "" {
+		return nil, false
+	}
+	if de.Status == 0 {
+		de.Status = status
+	}
+	return de, true
+}
+
+// Wrap err with the mapped *errs.MisoErr if it's caused by a dify error response (i.e., miso.HttpError).
+//
+// The returned error unwraps to *DifyError and then the original err.
+func wrapDifyErr(err error, msg string, args ...any) error {
+	if err == nil {
+		return nil
+	}
+	de := &DifyError{}
+	if errors.As(err, &de) {
+		return de.MisoErr().Wrapf(err, msg, args...)
+	}
+	var he miso.HttpError
+	if !errors.As(err, &he) {
+		return errs.Wrapf(err, msg, args...)
+	}
+	de, ok := parseDifyError(he.StatusCode, he.Body)
+	if !ok {
+		de = &DifyError{Status: he.StatusCode, Message: he.Body}
+	}
+	de.cause = err
+	return de.MisoErr().Wrapf(de, msg, args...)
+}
@@ -0,0 +1,186 @@
+package dify
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/curtisnewbie/miso/errs"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util/async"
+)
+
+// Methods to fuse records retrieved from multiple datasets.
+const (
+	FusionRRF      = "rrf"      // reciprocal rank fusion, sum of weight / (k + rank), scores are ignored
+	FusionWeighted = "weighted" // weight * score, scores are normalized if NormalizeScores is true
+)
+
+type FederatedDataset struct {
+	DatasetId      string
+	RetrievalModel *RetrieveModelParam // overrides FederatedRetrieveReq.RetrievalModel
+	Weight         float64             // weight of the dataset, by default 1
+}
+
+type FederatedRetrieveReq struct {
+	Query          string
+	Datasets       []FederatedDataset
+	RetrievalModel *RetrieveModelParam // retrieval model of all datasets, may be nil
+
+	Fusion          string // [FusionRRF] or [FusionWeighted], by default [FusionRRF]
+	RrfK            int    // k of reciprocal rank fusion, by default 60
+	NormalizeScores bool   // min-max normalize scores of each dataset before weighted fusion
+	TopK            int    // max number of the fused records, <= 0 means no limit
+	Parallel        int    // max number of datasets queried concurrently, by default 8
+}
+
+type FederatedRecord struct {
+	RetrievedRecord
+	DatasetId  string
+	Rank       int     // rank in the dataset, starts from 1
+	FusedScore float64 // score used to rank the fused records
+}
+
+type FederatedDatasetResult struct {
+	DatasetId string
+	Records   int // number of records retrieved from the dataset
+	Latency   time.Duration
+	Err       error // nil if the dataset is retrieved successfully
+}
+
+type FederatedRetrieveRes struct {
+	Records  []FederatedRecord        // fused records, ranked by FusedScore in descending order
+	Datasets []FederatedDatasetResult // in the same order as FederatedRetrieveReq.Datasets
+}
+
+// Retrieve records from multiple datasets concurrently, and fuse them into one ranked list.
+//
+// Records of the same segment are merged, with FusedScore accumulated in [FusionRRF] or the highest one kept in
+// [FusionWeighted]. Failed datasets are reported in FederatedRetrieveRes.Datasets, error is only returned when the request
+// is invalid or all datasets fail.
+func FederatedRetrieve(rail miso.Rail, host string, apiKey string, req FederatedRetrieveReq) (FederatedRetrieveRes, error) {
+	if len(req.Datasets) < 1 {
+		return FederatedRetrieveRes{}, ErrInvalidParam.WithInternalMsg("datasets is empty")
+	}
+	for _, d := range req.Datasets {
+		if d.DatasetId == "" {
+			return FederatedRetrieveRes{}, ErrInvalidParam.WithInternalMsg("datasetId is empty")
+		}
+	}
+	if req.Fusion == "" {
+		req.Fusion = FusionRRF
+	}
+	if req.Fusion != FusionRRF && req.Fusion != FusionWeighted {
+		return FederatedRetrieveRes{}, ErrInvalidParam.WithInternalMsg("invalid fusion method: %v", req.Fusion)
+	}
+	if req.RrfK < 1 {
+		req.RrfK = 60
+	}
+	if req.Parallel < 1 {
+		req.Parallel = 8
+	}
+
+	pool := async.NewAsyncPool(req.Parallel)
+	defer pool.StopAndWait()
+
+	results := make([]FederatedDatasetResult, len(req.Datasets))
+	records := make([][]RetrievedRecord, len(req.Datasets))
+	var wg sync.WaitGroup
+	for i, d := range req.Datasets {
+		wg.Add(1)
+		pool.Go(func() {
+			defer wg.Done()
+			model := req.RetrievalModel
+			if d.RetrievalModel != nil {
+				model = d.RetrievalModel
+			}
+			start := time.Now()
+			res, err := Retrieve(rail, host, apiKey, d.DatasetId, RetrieveReq{Query: req.Query, RetrievalModel: model})
+			results[i] = FederatedDatasetResult{DatasetId: d.DatasetId, Records: len(res.Records), Latency: time.Since(start), Err: err}
+			if err != nil {
+				rail.Warnf("Failed to retrieve dataset %v, %v", d.DatasetId, err)
+				return
+			}
+			records[i] = res.Records
+		})
+	}
+	wg.Wait()
+
+	out := FederatedRetrieveRes{Datasets: results}
+	if !slices.ContainsFunc(results, func(r FederatedDatasetResult) bool { return r.Err == nil }) {
+		return out, errs.Wrapf(results[0].Err, "all %v datasets failed", len(results))
+	}
+
+	var fused []FederatedRecord
+	idx := map[string]int{}
+	for i, d := range req.Datasets {
+		weight := d.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		scores := fusedScores(req, records[i], weight)
+		for j, r := range records[i] {
+			fr := FederatedRecord{RetrievedRecord: r, DatasetId: d.DatasetId, Rank: j + 1, FusedScore: scores[j]}
+			key := r.Segment.ID
+			if key == "" {
+				fused = append(fused, fr)
+				continue
+			}
+			k, ok := idx[key]
+			if !ok {
+				idx[key] = len(fused)
+				fused = append(fused, fr)
+				continue
+			}
+			if req.Fusion == FusionRRF {
+				fr.FusedScore += fused[k].FusedScore
+				if fused[k].Rank <= fr.Rank {
+					fr.RetrievedRecord, fr.DatasetId, fr.Rank = fused[k].RetrievedRecord, fused[k].DatasetId, fused[k].Rank
+				}
+				fused[k] = fr
+			} else if fr.FusedScore > fused[k].FusedScore {
+				fused[k] = fr
+			}
+		}
+	}
+	slices.SortStableFunc(fused, func(a, b FederatedRecord) int { return cmp.Compare(b.FusedScore, a.FusedScore) })
+	if req.TopK > 0 && len(fused) > req.TopK {
+		fused = fused[:req.TopK]
+	}
+	out.Records = fused
+	return out, nil
+}
+
+// Fused scores of records retrieved from one dataset, records are ranked by dify already.
+func fusedScores(req FederatedRetrieveReq, records []RetrievedRecord, weight float64) []float64 {
+	scores := make([]float64, len(records))
+	if req.Fusion == FusionRRF {
+		for i := range records {
+			scores[i] = weight / float64(req.RrfK+i+1)
+		}
+		return scores
+	}
+
+	lo, hi := 0.0, 0.0
+	for i, r := range records {
+		if i == 0 || r.Score < lo {
+			lo = r.Score
+		}
+		if i == 0 || r.Score > hi {
+			hi = r.Score
+		}
+	}
+	for i, r := range records {
+		s := r.Score
+		if req.NormalizeScores {
+			if hi > lo {
+				s = (s - lo) / (hi - lo)
+			} else if hi > 0 {
+				s = 1
+			}
+		}
+		scores[i] = weight * s
+	}
+	return scores
+}
@@ -5,7 +5,6 @@ import (
 	"io"
 	"os"
 
-	"github.com/curtisnewbie/miso/errs"
 	"github.com/curtisnewbie/miso/miso"
 )
 
@@ -39,7 +38,7 @@ func (u UploadFileRes) ToFileInput() FileInput {
 func UploadFile(rail miso.Rail, host string, apiKey string, user string, file *os.File, filename string) (UploadFileRes, error) {
 	url := host + "/v1/files/upload"
 	var res UploadFileRes
-	err := miso.NewClient(rail, url).
+	err := newClient(rail, url).
 		Require2xx().
 		AddAuthBearer(apiKey).
 		PostFormData(map[string]io.Reader{
@@ -48,7 +47,7 @@ func UploadFile(rail miso.Rail, host string, apiKey string, user string, file *o
 		}).
 		Json(&res)
 	if err != nil {
-		return res, errs.Wrapf(err, "dify UploadFile failed")
+		return res, wrapDifyErr(err, "dify UploadFile failed")
 	}
 	rail.Infof("File Uploaded %#v", res)
 	return res, nil
@@ -0,0 +1,337 @@
+package dify
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/curtisnewbie/miso/errs"
+	"github.com/curtisnewbie/miso/miso"
+)
+
+const (
+	LbRoundRobin    = "round-robin"
+	LbLeastInflight = "least-inflight"
+
+	hostPoolPlaceholder = "http://dify-host-pool"
+)
+
+type HostPoolConfig struct {
+	Strategy            string        // LbRoundRobin or LbLeastInflight, by default LbRoundRobin
+	EjectTimeout        time.Duration // how long a host is considered unhealthy after connection error or failed health check, by default 10s
+	HealthCheckInterval time.Duration // interval of active health check, by default 0, i.e., only passive health check on connection errors
+	HealthCheckPath     string        // path of active health check, by default /health
+	HealthCheckTimeout  time.Duration // timeout of active health check, by default 3s
+}
+
+type HostStatus struct {
+	Host     string
+	Healthy  bool
+	Inflight int64
+}
+
+type hostState struct {
+	inflight       atomic.Int64
+	unhealthyUntil atomic.Int64 // unix nano
+}
+
+func (h *hostState) healthy(now time.Time) bool {
+	return h.unhealthyUntil.Load() <= now.UnixNano()
+}
+
+// Pool of dify hosts with load balancing and failover.
+//
+// Use [NewHostPool] or [NewServiceHostPool] to create one.
+type HostPool struct {
+	conf  HostPoolConfig
+	hosts func(rail miso.Rail) ([]string, error)
+	rr    atomic.Uint64
+
+	mu     sync.Mutex
+	states map[string]*hostState
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// Create HostPool with a static list of hosts, e.g., http://dify-a:5001, http://dify-b:5001.
+func NewHostPool(hosts []string, options ...func(c *HostPoolConfig)) *HostPool {
+	hosts = append([]string(nil), hosts...)
+	for i, h := range hosts {
+		hosts[i] = strings.TrimSuffix(h, "/")
+	}
+	return newHostPool(func(rail miso.Rail) ([]string, error) { return hosts, nil }, options...)
+}
+
+// Create HostPool with hosts resolved from miso's service registry (e.g., consul) on each request.
+func NewServiceHostPool(service string, options ...func(c *HostPoolConfig)) *HostPool {
+	return newHostPool(func(rail miso.Rail) ([]string, error) {
+		sr := miso.GetServiceRegistry()
+		if sr == nil {
+			return nil, errs.NewErrf("no service registry available, failed to resolve dify service %v", service)
+		}
+		servers, err := sr.ListServers(rail, service)
+		if err != nil {
+			return nil, errs.Wrapf(err, "failed to resolve dify service %v", service)
+		}
+		hosts := make([]string, 0, len(servers))
+		for _, s := range servers {
+			hosts = append(hosts, strings.TrimSuffix(s.BuildUrl(""), "/"))
+		}
+		return hosts, nil
+	}, options...)
+}
+
+func newHostPool(hosts func(rail miso.Rail) ([]string, error), options ...func(c *HostPoolConfig)) *HostPool {
+	conf := HostPoolConfig{
+		Strategy:           LbRoundRobin,
+		EjectTimeout:       10 * time.Second,
+		HealthCheckPath:    "/health",
+		HealthCheckTimeout: 3 * time.Second,
+	}
+	for _, op := range options {
+		op(&conf)
+	}
+	p := &HostPool{conf: conf, hosts: hosts, states: map[string]*hostState{}, stop: make(chan struct{})}
+	if conf.HealthCheckInterval > 0 {
+		go p.healthCheckLoop()
+	}
+	return p
+}
+
+// Stop active health check.
+func (p *HostPool) Close() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// Status of the known hosts.
+func (p *HostPool) Status(rail miso.Rail) ([]HostStatus, error) {
+	hosts, err := p.hosts(rail)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	l := make([]HostStatus, 0, len(hosts))
+	for _, h := range hosts {
+		s := p.state(h)
+		l = append(l, HostStatus{Host: h, Healthy: s.healthy(now), Inflight: s.inflight.Load()})
+	}
+	return l, nil
+}
+
+// Create miso.HealthIndicator that reports dify as unhealthy when none of the hosts is healthy.
+func (p *HostPool) HealthIndicator(name string) miso.HealthIndicator {
+	return miso.HealthIndicator{
+		Name: name,
+		CheckHealth: func(rail miso.Rail) bool {
+			l, err := p.Status(rail)
+			if err != nil {
+				return false
+			}
+			for _, s := range l {
+				if s.Healthy {
+					return true
+				}
+			}
+			return false
+		},
+	}
+}
+
+func (p *HostPool) state(host string) *hostState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.states[host]
+	if !ok {
+		s = &hostState{}
+		p.states[host] = s
+	}
+	return s
+}
+
+func (p *HostPool) eject(host string) {
+	p.state(host).unhealthyUntil.Store(time.Now().Add(p.conf.EjectTimeout).UnixNano())
+}
+
+// Select host that is not tried yet, healthy hosts are preferred.
+func (p *HostPool) pick(hosts []string, tried map[string]struct{}) (string, bool) {
+	now := time.Now()
+	var healthy, unhealthy []string
+	for _, h := range hosts {
+		if _, ok := tried[h]; ok {
+			continue
+		}
+		if p.state(h).healthy(now) {
+			healthy = append(healthy, h)
+		} else {
+			unhealthy = append(unhealthy, h)
+		}
+	}
+	candidates := healthy
+	if len(candidates) < 1 {
+		candidates = unhealthy
+	}
+	if len(candidates) < 1 {
+		return "", false
+	}
+
+	start := int(p.rr.Add(1) % uint64(len(candidates)))
+	if p.conf.Strategy != LbLeastInflight {
+		return candidates[start], true
+	}
+	sel := candidates[start]
+	least := p.state(sel).inflight.Load()
+	for i := 1; i < len(candidates); i++ {
+		h := candidates[(start+i)%len(candidates)]
+		if n := p.state(h).inflight.Load(); n < least {
+			sel, least = h, n
+		}
+	}
+	return sel, true
+}
+
+func (p *HostPool) healthCheckLoop() {
+	tk := time.NewTicker(p.conf.HealthCheckInterval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-tk.C:
+			p.checkHealth(miso.EmptyRail())
+		}
+	}
+}
+
+func (p *HostPool) checkHealth(rail miso.Rail) {
+	hosts, err := p.hosts(rail)
+	if err != nil {
+		rail.Warnf("Failed to list dify hosts, %v", err)
+		return
+	}
+	for _, h := range hosts {
+		r, cancel := rail.WithTimeout(p.conf.HealthCheckTimeout)
+		err := miso.NewClient(r, h+p.conf.HealthCheckPath).Require2xx().Get().Ok()
+		cancel()
+		if err != nil {
+			rail.Warnf("Dify host %v is unhealthy, %v", h, err)
+			p.eject(h)
+		} else {
+			p.state(h).unhealthyUntil.Store(0)
+		}
+	}
+}
+
+// Create Api that sends requests to the hosts in HostPool.
+//
+// Requests that failed to connect (i.e., dns or dial error) are sent to the next host. Requests failed after the connection
+// is established are not retried, since the host may have received them already.
+func NewPoolApi(p *HostPool) Api {
+	return Api{host: func() string { return hostPoolPlaceholder }}.WithHostPool(p)
+}
+
+// Create Api that sends requests to the hosts in HostPool.
+//
+// See [NewPoolApi].
+func (a Api) WithHostPool(p *HostPool) Api {
+	a.host = func() string { return hostPoolPlaceholder }
+	a.pool = p
+	return a
+}
+
+type hostPoolTransport struct {
+	next http.RoundTripper
+	pool *HostPool
+}
+
+func (t *hostPoolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rail := miso.NewRail(req.Context())
+	hosts, err := t.pool.hosts(rail)
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) < 1 {
+		return nil, errs.NewErrf("no dify host available")
+	}
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	tried := map[string]struct{}{}
+	for attempt := 0; ; attempt++ {
+		host, ok := t.pool.pick(hosts, tried)
+		if !ok {
+			return nil, err // all hosts are tried, return last error
+		}
+		tried[host] = struct{}{}
+
+		r, e := rewriteHost(req, host)
+		if e != nil {
+			return nil, e
+		}
+		if attempt > 0 && req.GetBody != nil {
+			body, e := req.GetBody()
+			if e != nil {
+				return nil, e
+			}
+			r.Body = body
+		}
+
+		s := t.pool.state(host)
+		s.inflight.Add(1)
+		var resp *http.Response
+		resp, err = t.next.RoundTrip(r)
+		if err == nil {
+			resp.Body = &inflightBody{ReadCloser: resp.Body, state: s}
+			return resp, nil
+		}
+		s.inflight.Add(-1)
+
+		if req.Context().Err() != nil || !isDialError(err) {
+			return nil, err
+		}
+		t.pool.eject(host)
+		if !replayable {
+			return nil, err
+		}
+		rail.Warnf("Dify host %v failed, failover to next host, %v", host, err)
+	}
+}
+
+// Whether err happens before the connection is established, i.e., the request is not sent.
+func isDialError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func rewriteHost(req *http.Request, host string) (*http.Request, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, errs.Wrapf(err, "invalid dify host %v", host)
+	}
+	r := req.Clone(req.Context())
+	r.URL.Scheme = u.Scheme
+	r.URL.Host = u.Host
+	r.URL.Path = strings.TrimSuffix(u.Path, "/") + req.URL.Path
+	r.Host = ""
+	return r, nil
+}
+
+type inflightBody struct {
+	io.ReadCloser
+	state *hostState
+	once  sync.Once
+}
+
+func (b *inflightBody) Close() error {
+	b.once.Do(func() { b.state.inflight.Add(-1) })
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,189 @@
+package dify
+
+import (
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/curtisnewbie/miso/errs"
+	"github.com/curtisnewbie/miso/miso"
+)
+
+// Types of dataset metadata.
+const (
+	MetaTypeString = "string"
+	MetaTypeNumber = "number"
+	MetaTypeTime   = "time"
+)
+
+// Comparison operators of MetadataFilteringCondition.
+const (
+	MetaOpContains    = "contains"
+	MetaOpNotContains = "not contains"
+	MetaOpStartWith   = "start with"
+	MetaOpEndWith     = "end with"
+	MetaOpIs          = "is"
+	MetaOpIsNot       = "is not"
+	MetaOpEmpty       = "empty"
+	MetaOpNotEmpty    = "not empty"
+	MetaOpEq          = "="
+	MetaOpNe          = "≠"
+	MetaOpGt          = ">"
+	MetaOpLt          = "<"
+	MetaOpGte         = "≥"
+	MetaOpLte         = "≤"
+	MetaOpBefore      = "before"
+	MetaOpAfter       = "after"
+)
+
+var (
+	// Comparison operators valid for each metadata type, [MetaOpEmpty] and [MetaOpNotEmpty] are valid for all types.
+	metaTypeOps = map[string][]string{
+		MetaTypeString: {MetaOpContains, MetaOpNotContains, MetaOpStartWith, MetaOpEndWith, MetaOpIs, MetaOpIsNot},
+		MetaTypeNumber: {MetaOpEq, MetaOpNe, MetaOpGt, MetaOpLt, MetaOpGte, MetaOpLte},
+		MetaTypeTime:   {MetaOpBefore, MetaOpAfter},
+	}
+
+	// Built-in metadata fields available when ListDatasetMetadataRes.BuiltInFieldEnabled is true.
+	builtInMetadata = []ListedDatasetMetadata{
+		{Name: "document_name", Type: MetaTypeString},
+		{Name: "uploader", Type: MetaTypeString},
+		{Name: "upload_date", Type: MetaTypeTime},
+		{Name: "last_update_date", Type: MetaTypeTime},
+		{Name: "source", Type: MetaTypeString},
+	}
+)
+
+// Metadata field used to build MetaFilter, e.g.,
+//
+//	dify.Meta("author").Is("x").And(dify.Meta("year").Gte(2024))
+type MetaField struct {
+	name string
+}
+
+// Typed builder of MetadataFilteringConditions, use [Meta] to create one.
+//
+// Dify only supports one logical operator for all conditions, mixing And and Or results in error when the filter is built.
+type MetaFilter struct {
+	conds   []metaCond
+	logical string
+	err     error
+}
+
+type metaCond struct {
+	typ  string // type of the value, empty for [MetaOpEmpty] and [MetaOpNotEmpty]
+	cond MetadataFilteringCondition
+}
+
+// Create MetaField of the metadata name.
+func Meta(name string) MetaField {
+	return MetaField{name: name}
+}
+
+func (f MetaField) cond(typ string, op string, value string) MetaFilter {
+	return MetaFilter{conds: []metaCond{{typ: typ, cond: MetadataFilteringCondition{Name: f.name, ComparisonOperator: op, Value: value}}}}
+}
+
+func (f MetaField) str(op string, v string) MetaFilter { return f.cond(MetaTypeString, op, v) }
+func (f MetaField) num(op string, v float64) MetaFilter {
+	return f.cond(MetaTypeNumber, op, strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+// Time value is formatted as unix timestamp in seconds, which is how dify stores time metadata.
+func (f MetaField) tm(op string, v time.Time) MetaFilter {
+	return f.cond(MetaTypeTime, op, strconv.FormatInt(v.Unix(), 10))
+}
+
+func (f MetaField) Is(v string) MetaFilter          { return f.str(MetaOpIs, v) }
+func (f MetaField) IsNot(v string) MetaFilter       { return f.str(MetaOpIsNot, v) }
+func (f MetaField) Contains(v string) MetaFilter    { return f.str(MetaOpContains, v) }
+func (f MetaField) NotContains(v string) MetaFilter { return f.str(MetaOpNotContains, v) }
+func (f MetaField) StartWith(v string) MetaFilter   { return f.str(MetaOpStartWith, v) }
+func (f MetaField) EndWith(v string) MetaFilter     { return f.str(MetaOpEndWith, v) }
+func (f MetaField) Eq(v float64) MetaFilter         { return f.num(MetaOpEq, v) }
+func (f MetaField) Ne(v float64) MetaFilter         { return f.num(MetaOpNe, v) }
+func (f MetaField) Gt(v float64) MetaFilter         { return f.num(MetaOpGt, v) }
+func (f MetaField) Lt(v float64) MetaFilter         { return f.num(MetaOpLt, v) }
+func (f MetaField) Gte(v float64) MetaFilter        { return f.num(MetaOpGte, v) }
+func (f MetaField) Lte(v float64) MetaFilter        { return f.num(MetaOpLte, v) }
+func (f MetaField) Before(v time.Time) MetaFilter   { return f.tm(MetaOpBefore, v) }
+func (f MetaField) After(v time.Time) MetaFilter    { return f.tm(MetaOpAfter, v) }
+func (f MetaField) Empty() MetaFilter               { return f.cond("", MetaOpEmpty, "") }
+func (f MetaField) NotEmpty() MetaFilter            { return f.cond("", MetaOpNotEmpty, "") }
+
+func (f MetaFilter) And(o MetaFilter) MetaFilter { return f.join("and", o) }
+func (f MetaFilter) Or(o MetaFilter) MetaFilter  { return f.join("or", o) }
+
+func (f MetaFilter) join(logical string, o MetaFilter) MetaFilter {
+	if f.err != nil {
+		return f
+	}
+	if o.err != nil {
+		return o
+	}
+	if len(f.conds) < 1 {
+		return o
+	}
+	if len(o.conds) < 1 {
+		return f
+	}
+	for _, l := range []string{f.logical, o.logical} {
+		if l != "" && l != logical {
+			f.err = errs.NewErrf("mixing 'and' and 'or' in metadata filter is not supported")
+			return f
+		}
+	}
+	return MetaFilter{conds: append(slices.Clone(f.conds), o.conds...), logical: logical}
+}
+
+// Build MetadataFilteringConditions without checking the dataset's metadata fields.
+func (f MetaFilter) Build() (MetadataFilteringConditions, error) {
+	if f.err != nil {
+		return MetadataFilteringConditions{}, f.err
+	}
+	c := MetadataFilteringConditions{LogicalOperator: f.logical}
+	if c.LogicalOperator == "" {
+		c.LogicalOperator = "and"
+	}
+	for _, mc := range f.conds {
+		if mc.cond.Name == "" {
+			return MetadataFilteringConditions{}, errs.NewErrf("metadata name is empty")
+		}
+		c.Conditions = append(c.Conditions, mc.cond)
+	}
+	return c, nil
+}
+
+// Build MetadataFilteringConditions, the metadata names and the operators are validated against the dataset's metadata
+// fields, i.e., the result of [ListDatasetMetadata].
+func (f MetaFilter) BuildFor(md ListDatasetMetadataRes) (MetadataFilteringConditions, error) {
+	c, err := f.Build()
+	if err != nil {
+		return c, err
+	}
+	fields := slices.Clone(md.DocMetadata)
+	if md.BuiltInFieldEnabled {
+		fields = append(fields, builtInMetadata...)
+	}
+	for _, mc := range f.conds {
+		i := slices.IndexFunc(fields, func(m ListedDatasetMetadata) bool { return m.Name == mc.cond.Name })
+		if i < 0 {
+			return MetadataFilteringConditions{}, errs.NewErrf("metadata '%v' not found", mc.cond.Name)
+		}
+		typ := fields[i].Type
+		if mc.typ != "" && !slices.Contains(metaTypeOps[typ], mc.cond.ComparisonOperator) {
+			return MetadataFilteringConditions{}, errs.NewErrf("operator '%v' is not valid for metadata '%v' of type '%v'",
+				mc.cond.ComparisonOperator, mc.cond.Name, typ)
+		}
+	}
+	return c, nil
+}
+
+// Build MetadataFilteringConditions of the dataset, the filter is validated using [ListDatasetMetadata].
+func BuildMetaFilter(rail miso.Rail, host string, apiKey string, datasetId string, f MetaFilter) (MetadataFilteringConditions, error) {
+	md, err := ListDatasetMetadata(rail, host, apiKey, datasetId)
+	if err != nil {
+		return MetadataFilteringConditions{}, err
+	}
+	return f.BuildFor(md)
+}
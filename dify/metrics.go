@@ -0,0 +1,193 @@
+package dify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/curtisnewbie/miso/errs"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util/json"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	statusError = "error" // status label of requests that failed without response
+)
+
+var (
+	requestDurationHisto *prometheus.HistogramVec
+	requestErrorCounter  *prometheus.CounterVec
+	streamTTFTHisto      *prometheus.HistogramVec
+	streamDurationHisto  *prometheus.HistogramVec
+	streamEventsHisto    *prometheus.HistogramVec
+	activeStreamsGauge   *prometheus.GaugeVec
+	rateLimitWaitHisto   *prometheus.HistogramVec
+	metricsOnce          sync.Once
+)
+
+func metricsEnabled() bool {
+	return miso.GetPropBool(PropMetricsEnabled)
+}
+
+func initMetrics() {
+	metricsOnce.Do(func() {
+		requestDurationHisto = registerMetric(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "dify_request_duration_seconds",
+			Help: "Duration of dify requests until the response header is received",
+		}, []string{"operation", "app", "status", "code"}))
+		requestErrorCounter = registerMetric(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dify_request_errors_total",
+			Help: "Number of dify requests that failed, including error events in SSE streams",
+		}, []string{"operation", "app", "status", "code"}))
+		streamTTFTHisto = registerMetric(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dify_stream_first_token_seconds",
+			Help:    "Time to first token of dify SSE streams",
+			Buckets: []float64{.1, .25, .5, 1, 2, 3, 5, 8, 13, 20, 30, 60},
+		}, []string{"operation", "app"}))
+		streamDurationHisto = registerMetric(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dify_stream_duration_seconds",
+			Help:    "Total duration of dify SSE streams",
+			Buckets: []float64{.5, 1, 2, 5, 10, 20, 30, 60, 120, 300, 600},
+		}, []string{"operation", "app", "code"}))
+		streamEventsHisto = registerMetric(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dify_stream_events",
+			Help:    "Number of events in dify SSE streams",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+		}, []string{"operation", "app"}))
+		activeStreamsGauge = registerMetric(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dify_active_streams",
+			Help: "Number of active dify SSE streams",
+		}, []string{"operation", "app"}))
+		rateLimitWaitHisto = registerMetric(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dify_rate_limit_wait_seconds",
+			Help:    "Time dify requests waited for the client side rate limiter",
+			Buckets: []float64{0, .01, .05, .1, .25, .5, 1, 2, 5, 10, 30},
+		}, []string{"group"}))
+	})
+}
+
+func registerMetric[T prometheus.Collector](c T) T {
+	if err := prometheus.DefaultRegisterer.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			return are.ExistingCollector.(T)
+		}
+		panic(errs.Wrapf(err, "failed to register dify metrics"))
+	}
+	return c
+}
+
+type metricsTransport struct {
+	next http.RoundTripper
+	app  string
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	initMetrics()
+	op := Operation(req.Method, req.URL.Path)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	took := time.Since(start)
+
+	status, code := statusError, ""
+	if err != nil {
+		code = transportErrCode(req.Context(), err)
+	} else {
+		status = strconv.Itoa(resp.StatusCode)
+		if resp.StatusCode >= 400 {
+			code = peekErrCode(resp)
+		}
+	}
+	requestDurationHisto.WithLabelValues(op, t.app, status, code).Observe(took.Seconds())
+	if err != nil || resp.StatusCode >= 400 {
+		requestErrorCounter.WithLabelValues(op, t.app, status, code).Inc()
+	}
+	return resp, err
+}
+
+func transportErrCode(ctx context.Context, err error) string {
+	switch {
+	case errors.Is(err, ErrCircuitOpen):
+		return ErrCircuitOpen.Code()
+	case errors.Is(ctx.Err(), context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return "timeout"
+	}
+	return "connection_error"
+}
+
+// Read dify error code in response body, the body is restored for the caller.
+func peekErrCode(resp *http.Response) string {
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+	if err != nil {
+		return ""
+	}
+	var de struct {
+		Code string `json:"code"`
+	}
+	if err := json.ParseJson(b, &de); err != nil {
+		return ""
+	}
+	return de.Code
+}
+
+// Metrics of a SSE stream.
+type streamMetrics struct {
+	op      string
+	app     string
+	start   time.Time
+	events  int
+	first   bool
+	enabled bool
+}
+
+func startStreamMetrics(rail miso.Rail, op string) *streamMetrics {
+	m := &streamMetrics{op: op, start: time.Now(), enabled: metricsEnabled()}
+	if !m.enabled {
+		return m
+	}
+	initMetrics()
+	if a, ok := rail.Context().Value(apiCtxKey{}).(Api); ok {
+		m.app = a.scope
+	}
+	activeStreamsGauge.WithLabelValues(m.op, m.app).Inc()
+	return m
+}
+
+// Record SSE event, the first message or agent_message event is considered the first token.
+func (m *streamMetrics) event(event string, code string, status int) {
+	m.events++
+	if !m.enabled {
+		return
+	}
+	switch event {
+	case EventTypeMessage, EventTypeAgentMessage:
+		if !m.first {
+			m.first = true
+			streamTTFTHisto.WithLabelValues(m.op, m.app).Observe(time.Since(m.start).Seconds())
+		}
+	case EventTypeError:
+		requestErrorCounter.WithLabelValues(m.op, m.app, strconv.Itoa(status), code).Inc()
+	}
+}
+
+// End of stream, code is the error code if the stream failed.
+func (m *streamMetrics) end(code string) {
+	if !m.enabled {
+		return
+	}
+	activeStreamsGauge.WithLabelValues(m.op, m.app).Dec()
+	streamDurationHisto.WithLabelValues(m.op, m.app, code).Observe(time.Since(m.start).Seconds())
+	streamEventsHisto.WithLabelValues(m.op, m.app).Observe(float64(m.events))
+}
@@ -3,7 +3,6 @@ package dify
 import (
 	"fmt"
 
-	"github.com/curtisnewbie/miso/errs"
 	"github.com/curtisnewbie/miso/miso"
 )
 
@@ -31,7 +30,7 @@ func SendMsgFeedback(rail miso.Rail, host string, apiKey string, req MsgFeedback
 	if req.Rating != "" {
 		rating = &req.Rating
 	}
-	s, err := miso.NewClient(rail, url).
+	s, err := newClient(rail, url).
 		Require2xx().
 		AddAuthBearer(apiKey).
 		PostJson(apiMsgFeedbackReq{
@@ -41,7 +40,7 @@ func SendMsgFeedback(rail miso.Rail, host string, apiKey string, req MsgFeedback
 		}).
 		Str()
 	if err != nil {
-		return errs.Wrapf(err, "dify SendMsgFeedback failed")
+		return wrapDifyErr(err, "dify SendMsgFeedback failed")
 	}
 	rail.Infof("Request success, %v", s)
 	return nil
@@ -0,0 +1,417 @@
+package dify
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/curtisnewbie/miso/errs"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util/json"
+)
+
+const (
+	// Header of dify conversation id in OpenAI compatible requests and responses.
+	HeaderConversationId = "X-Dify-Conversation-Id"
+)
+
+type OpenAIChatReq struct {
+	Model         string          `json:"model"`
+	Messages      []OpenAIMessage `json:"messages"`
+	Stream        bool            `json:"stream"`
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options,omitempty"`
+	User string `json:"user"`
+
+	ConversationId string `json:"conversation_id,omitempty"` // extension, dify conversation id, same as X-Dify-Conversation-Id header
+}
+
+type OpenAIMessage struct {
+	Role    string `json:"role"`    // system, user or assistant
+	Content any    `json:"content"` // string or array of content parts, e.g., {"type": "text", "text": "..."}, {"type": "image_url", "image_url": {"url": "..."}}
+}
+
+type OpenAIChatCompletion struct {
+	Id             string         `json:"id"`
+	Object         string         `json:"object"` // chat.completion or chat.completion.chunk
+	Created        int64          `json:"created"`
+	Model          string         `json:"model"`
+	Choices        []OpenAIChoice `json:"choices"`
+	Usage          *OpenAIUsage   `json:"usage,omitempty"`
+	ConversationId string         `json:"conversation_id,omitempty"` // extension, dify conversation id
+}
+
+type OpenAIChoice struct {
+	Index        int                   `json:"index"`
+	Message      *OpenAIMessageContent `json:"message,omitempty"`
+	Delta        *OpenAIMessageContent `json:"delta,omitempty"`
+	FinishReason *string               `json:"finish_reason"`
+}
+
+type OpenAIMessageContent struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content"`
+}
+
+type OpenAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type OpenAIErrorRes struct {
+	Error OpenAIError `json:"error"`
+}
+
+type OpenAIError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+}
+
+// OpenAI compatible chat completions handler (i.e., POST /v1/chat/completions) over dify chat apps.
+//
+// The model name is mapped to the named app in [KeyRegistry], i.e., 'dify.apps.<model>'. Dify keeps the chat history
+// on its own, so only the last user message is sent as the query. The conversation is continued if the conversation id
+// is provided explicitly using X-Dify-Conversation-Id header (or the conversation_id field), or if the user field is
+// present and the previous messages match the ones of a recent completion of the same caller and user. Otherwise, the
+// previous messages are sent as a transcript.
+//
+// E.g., to use it in miso:
+//
+//	h := dify.NewOpenAIHandler(dify.Get())
+//	miso.HttpPost("/v1/chat/completions", miso.RawHandler(func(inb *miso.Inbound) {
+//		h.ServeHTTP(inb.Unwrap())
+//	}))
+type OpenAIHandler struct {
+	Api Api
+
+	// Map model name to app name in KeyRegistry, by default the model name is used as is.
+	AppName func(model string) string
+
+	// Name of the input variable that system message is passed to, empty to ignore system messages.
+	SystemInput string
+
+	// How long the conversation of a completion is remembered, by default 1h.
+	ConversationTTL time.Duration
+
+	// Identity of the caller, remembered conversations are only continued for the same caller, by default the
+	// Authorization header is used.
+	Caller func(r *http.Request) string
+
+	// Max size of the request body in bytes, by default 4MB.
+	MaxBodySize int64
+
+	mu            sync.Mutex
+	conversations map[string]openAIConversation
+}
+
+type openAIConversation struct {
+	id       string
+	expireAt time.Time
+}
+
+func NewOpenAIHandler(a Api) *OpenAIHandler {
+	return &OpenAIHandler{
+		Api:             a,
+		ConversationTTL: time.Hour,
+		MaxBodySize:     4 << 20,
+		conversations:   map[string]openAIConversation{},
+	}
+}
+
+func (h *OpenAIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rail := miso.NewRail(r.Context())
+	if h.MaxBodySize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.MaxBodySize)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			writeOpenAIError(w, http.StatusRequestEntityTooLarge, OpenAIError{Message: "Request body is too large", Type: "invalid_request_error", Code: "request_too_large"})
+			return
+		}
+		writeOpenAIError(w, http.StatusBadRequest, OpenAIError{Message: "Failed to read request body", Type: "invalid_request_error"})
+		return
+	}
+	var req OpenAIChatReq
+	if err := json.ParseJson(body, &req); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, OpenAIError{Message: "Invalid request body", Type: "invalid_request_error", Code: "invalid_json"})
+		return
+	}
+	if req.Model == "" || len(req.Messages) < 1 || req.Messages[len(req.Messages)-1].Role != "user" {
+		writeOpenAIError(w, http.StatusBadRequest, OpenAIError{Message: "model is required and the last message must be a user message", Type: "invalid_request_error"})
+		return
+	}
+
+	history, last := req.Messages[:len(req.Messages)-1], req.Messages[len(req.Messages)-1]
+	query, files := openAIContent(last.Content)
+	creq := ChatMessageReq{Query: query, User: req.User, Files: files, Inputs: map[string]any{}}
+
+	creq.ConversationId = req.ConversationId
+	if v := r.Header.Get(HeaderConversationId); v != "" {
+		creq.ConversationId = v
+	}
+	caller := h.caller(r)
+	if creq.ConversationId == "" && req.User != "" {
+		creq.ConversationId = h.lookupConversation(req.Model, caller, req.User, history)
+	}
+	var transcript []string
+	for _, m := range history {
+		text, _ := openAIContent(m.Content)
+		switch m.Role {
+		case "system":
+			if h.SystemInput != "" {
+				creq.Inputs[h.SystemInput] = text
+			}
+		case "user", "assistant":
+			transcript = append(transcript, m.Role+": "+text)
+		}
+	}
+	if creq.ConversationId == "" && len(transcript) > 0 {
+		creq.Query = strings.Join(append(transcript, "user: "+query), "\n")
+	}
+
+	appName := req.Model
+	if h.AppName != nil {
+		appName = h.AppName(req.Model)
+	}
+	events := h.Api.App(appName).StreamChat(rail, creq)
+
+	var (
+		answer  strings.Builder
+		convId  string
+		id      string
+		created = time.Now().Unix()
+		usage   *OpenAIUsage
+		sw      *openAIStreamWriter
+	)
+	if req.Stream {
+		sw = &openAIStreamWriter{w: w, rc: http.NewResponseController(w)}
+	}
+	chunk := func(delta *OpenAIMessageContent, finish *string) OpenAIChatCompletion {
+		return OpenAIChatCompletion{Id: id, Object: "chat.completion.chunk", Created: created, Model: req.Model,
+			Choices: []OpenAIChoice{{Delta: delta, FinishReason: finish}}}
+	}
+
+	for e, err := range events {
+		if err != nil {
+			rail.Warnf("OpenAI chat completion failed, %v", err)
+			status, oe := toOpenAIError(err)
+			if sw != nil && sw.started {
+				sw.send(OpenAIErrorRes{Error: oe})
+				sw.done()
+				return
+			}
+			writeOpenAIError(w, status, oe)
+			return
+		}
+		raw := e.RawEvent()
+		if convId == "" && raw.ConversationId != "" {
+			convId = raw.ConversationId
+			w.Header().Set(HeaderConversationId, convId)
+		}
+		if id == "" && raw.MessageId != "" {
+			id = "chatcmpl-" + raw.MessageId
+		}
+
+		switch e := e.(type) {
+		case ChatMessageChunk:
+			if sw != nil {
+				delta := &OpenAIMessageContent{Content: e.Answer}
+				if !sw.started {
+					delta.Role = "assistant"
+				}
+				sw.send(chunk(delta, nil))
+			}
+			answer.WriteString(e.Answer)
+		case ChatMessageEnd:
+			if u := e.Metadata.Usage; u != nil {
+				usage = &OpenAIUsage{PromptTokens: u.PromptTokens, CompletionTokens: u.CompletionTokens, TotalTokens: u.TotalTokens}
+			}
+		}
+	}
+
+	if convId != "" {
+		h.rememberConversation(req.Model, caller, req.User, append(req.Messages, OpenAIMessage{Role: "assistant", Content: answer.String()}), convId)
+	}
+	stop := "stop"
+	if sw != nil {
+		sw.send(chunk(&OpenAIMessageContent{}, &stop))
+		if usage != nil && req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+			c := chunk(nil, nil)
+			c.Choices = []OpenAIChoice{}
+			c.Usage = usage
+			sw.send(c)
+		}
+		sw.done()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.EncodeJson(w, OpenAIChatCompletion{
+		Id:      id,
+		Object:  "chat.completion",
+		Created: created,
+		Model:   req.Model,
+		Choices: []OpenAIChoice{{
+			Message:      &OpenAIMessageContent{Role: "assistant", Content: answer.String()},
+			FinishReason: &stop,
+		}},
+		Usage:          usage,
+		ConversationId: convId,
+	})
+}
+
+func (h *OpenAIHandler) caller(r *http.Request) string {
+	if h.Caller != nil {
+		return h.Caller(r)
+	}
+	return r.Header.Get("Authorization")
+}
+
+func (h *OpenAIHandler) lookupConversation(model string, caller string, user string, history []OpenAIMessage) string {
+	if len(history) < 1 {
+		return ""
+	}
+	k := openAIHistoryKey(model, caller, user, history)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c, ok := h.conversations[k]; ok && time.Now().Before(c.expireAt) {
+		return c.id
+	}
+	return ""
+}
+
+func (h *OpenAIHandler) rememberConversation(model string, caller string, user string, history []OpenAIMessage, convId string) {
+	if user == "" {
+		return
+	}
+	k := openAIHistoryKey(model, caller, user, history)
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conversations == nil {
+		h.conversations = map[string]openAIConversation{}
+	}
+	for k, c := range h.conversations {
+		if now.After(c.expireAt) {
+			delete(h.conversations, k)
+		}
+	}
+	h.conversations[k] = openAIConversation{id: convId, expireAt: now.Add(h.ConversationTTL)}
+}
+
+// Hash of the messages, system messages are ignored since clients may rewrite them.
+func openAIHistoryKey(model string, caller string, user string, history []OpenAIMessage) string {
+	hs := sha256.New()
+	fmt.Fprintf(hs, "%v\x00%v\x00%v\x00", model, caller, user)
+	for _, m := range history {
+		if m.Role == "system" {
+			continue
+		}
+		text, _ := openAIContent(m.Content)
+		fmt.Fprintf(hs, "%v\x00%v\x00", m.Role, strings.TrimSpace(text))
+	}
+	return hex.EncodeToString(hs.Sum(nil))
+}
+
+// Extract text and image urls in OpenAI message content.
+func openAIContent(c any) (string, []FileInput) {
+	switch v := c.(type) {
+	case string:
+		return v, nil
+	case []any:
+		var (
+			text  []string
+			files []FileInput
+		)
+		for _, p := range v {
+			part, ok := p.(map[string]any)
+			if !ok {
+				continue
+			}
+			switch part["type"] {
+			case "text":
+				if t, ok := part["text"].(string); ok {
+					text = append(text, t)
+				}
+			case "image_url":
+				if img, ok := part["image_url"].(map[string]any); ok {
+					if u, ok := img["url"].(string); ok && u != "" {
+						files = append(files, FileInput{Type: "image", TransferMethod: TransferMethodRemoteUrl, Url: u})
+					}
+				}
+			}
+		}
+		return strings.Join(text, "\n"), files
+	}
+	return "", nil
+}
+
+func toOpenAIError(err error) (int, OpenAIError) {
+	oe := OpenAIError{Message: "Unknown error", Type: "api_error"}
+	var me *errs.MisoErr
+	if errors.As(err, &me) && me.Msg() != "" {
+		oe.Message = me.Msg()
+	}
+	switch {
+	case errors.Is(err, ErrUnknownApp):
+		oe.Type, oe.Code = "invalid_request_error", "model_not_found"
+		return http.StatusNotFound, oe
+	case errors.Is(err, ErrInvalidParam), errors.Is(err, ErrConversationCompleted), errors.Is(err, ErrNotFound):
+		oe.Type = "invalid_request_error"
+		return http.StatusBadRequest, oe
+	case errors.Is(err, ErrProviderQuotaExceeded):
+		oe.Type, oe.Code = "insufficient_quota", "insufficient_quota"
+		return http.StatusTooManyRequests, oe
+	case errors.Is(err, ErrTooManyRequests):
+		oe.Type, oe.Code = "rate_limit_error", "rate_limit_exceeded"
+		return http.StatusTooManyRequests, oe
+	case errors.Is(err, ErrCircuitOpen), errors.Is(err, ErrAppUnavailable):
+		return http.StatusServiceUnavailable, oe
+	}
+	return http.StatusInternalServerError, oe
+}
+
+func writeOpenAIError(w http.ResponseWriter, status int, oe OpenAIError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.EncodeJson(w, OpenAIErrorRes{Error: oe})
+}
+
+// Write OpenAI style SSE stream, the header is written on the first chunk.
+type openAIStreamWriter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	started bool
+}
+
+func (s *openAIStreamWriter) write(data string) {
+	if !s.started {
+		s.started = true
+		s.w.Header().Set("Content-Type", "text/event-stream")
+		s.w.Header().Set("Cache-Control", "no-cache")
+		s.w.WriteHeader(http.StatusOK)
+	}
+	if _, err := fmt.Fprintf(s.w, "data: %s\n\n", data); err == nil {
+		_ = s.rc.Flush()
+	}
+}
+
+func (s *openAIStreamWriter) send(v any) {
+	s.write(json.TrySWriteJson(v))
+}
+
+func (s *openAIStreamWriter) done() {
+	s.write("[DONE]")
+}
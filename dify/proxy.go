@@ -0,0 +1,291 @@
+package dify
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/curtisnewbie/miso/errs"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util/json"
+	"github.com/tmaxmax/go-sse"
+)
+
+const (
+	// Keep consuming dify stream to completion after the downstream client disconnects.
+	//
+	// Dify fails to update the message status if the stream is closed halfway, and the chat gets stuck on RUNNING status.
+	// See https://github.com/langgenius/dify/issues/11852.
+	DisconnectContinue = "continue"
+
+	// Stop dify task and the stream after the downstream client disconnects.
+	DisconnectStop = "stop"
+
+	// Forward the upstream event type as is, dify doesn't name its events except ping.
+	EventNamingUpstream = "upstream"
+
+	// Name downstream events by the event field in dify's payload, e.g., message, message_end.
+	//
+	// Browser EventSource can then use addEventListener per event type.
+	EventNamingDify = "dify"
+)
+
+var (
+	ErrDownstreamDisconnected = errs.NewErrfCode("DIFY_DOWNSTREAM_DISCONNECTED", "Client disconnected")
+)
+
+// Config of proxied SSE stream.
+type ProxyConfig struct {
+	// What to do after downstream client disconnects, [DisconnectContinue] or [DisconnectStop].
+	//
+	// By default, it's 'dify.proxy.on-disconnect'.
+	OnDisconnect string
+
+	// Interval of SSE comments sent to downstream to keep the idle stream alive, 0 to disable.
+	//
+	// By default, it's 'dify.proxy.keep-alive-interval'.
+	KeepAliveInterval time.Duration
+
+	// Name of the downstream event, the upstream event type is forwarded if it returns empty string.
+	//
+	// By default, it's decided by 'dify.proxy.event-naming', i.e., [UpstreamEventName] or [DifyEventName].
+	EventName func(e SseEvent) string
+
+	// Extra events sent to downstream after dify stream ends.
+	AppendSseEvents []func() SseEvent
+
+	// Buffer of the stream, so that client can reconnect with Last-Event-ID to resume the stream, nil to disable.
+	//
+	// Note that enabling the buffer turns off OnDisconnect: the dify stream is always consumed to completion (unless
+	// it's evicted from the buffer) even if the client is gone, and the event ids are assigned by the buffer.
+	//
+	// By default, it's [GetStreamBuffer] if 'dify.proxy.buffer.enabled' is true.
+	Buffer *StreamBuffer
+
+	// Middlewares applied to each dify event in order before it's sent to downstream, e.g., [DropEvents], [RewriteEventJson].
+	//
+	// Middlewares see the upstream frame, EventName is applied to the frames they emit.
+	Middlewares []ProxyMiddleware
+}
+
+// Name downstream event using upstream event type.
+func UpstreamEventName(e SseEvent) string {
+	return e.Type
+}
+
+// Name downstream event using the event field in dify's payload, e.g., message, agent_thought, message_end.
+func DifyEventName(e SseEvent) string {
+	var v struct {
+		Event string `json:"event"`
+	}
+	if err := json.SParseJson(e.Data, &v); err != nil || v.Event == "" {
+		return e.Type
+	}
+	return v.Event
+}
+
+func newProxyConfig(opts ...func(c *ProxyConfig)) ProxyConfig {
+	c := ProxyConfig{
+		OnDisconnect:      miso.GetPropStr(PropProxyOnDisconnect),
+		KeepAliveInterval: miso.GetPropDuration(PropProxyKeepAliveInterval),
+		EventName:         UpstreamEventName,
+	}
+	if miso.GetPropStr(PropProxyEventNaming) == EventNamingDify {
+		c.EventName = DifyEventName
+	}
+	if miso.GetPropBool(PropProxyBufferEnabled) {
+		c.Buffer = GetStreamBuffer()
+	}
+	for _, op := range opts {
+		op(&c)
+	}
+	return c
+}
+
+// Proxy chat stream to downstream client.
+//
+// Downstream disconnect is detected using the request context, the dify stream is then either stopped or consumed to
+// completion, see [ProxyConfig].OnDisconnect. ErrDownstreamDisconnected is returned if the stream is stopped.
+//
+// If [ProxyConfig].Buffer is set, client can reconnect with Last-Event-ID to resume the stream, ErrStreamNotFound is
+// returned if the buffered stream is expired.
+func ProxyChat(rail miso.Rail, host string, apiKey string, req ChatMessageReq, w http.ResponseWriter, r *http.Request,
+	opts ...func(c *ProxyConfig)) (ChatMessageRes, error) {
+
+	conf := newProxyConfig(opts...)
+	if conf.Buffer != nil {
+		return proxyBufferedChat(rail, host, apiKey, req, w, r, conf)
+	}
+	sess, err := sse.Upgrade(w, r)
+	if err != nil {
+		return ChatMessageRes{}, err
+	}
+	pw := newProxyWriter(rail, sess, conf)
+
+	// the stream is not bound to the downstream request, see DisconnectContinue
+	ctx, cancel := context.WithCancel(context.WithoutCancel(rail.Context()))
+	defer cancel()
+	streamRail := miso.NewRail(ctx)
+
+	var (
+		taskMu sync.Mutex
+		taskId string
+	)
+	stop := func() {
+		taskMu.Lock()
+		id := taskId
+		taskMu.Unlock()
+		if id != "" {
+			stopChatTask(streamRail, host, apiKey, StopChatMessageReq{TaskId: id, User: req.User})
+		}
+		cancel()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	defer pw.disconnect() // no more writes after the handler returns
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-r.Context().Done():
+		}
+		pw.disconnect()
+		if conf.OnDisconnect == DisconnectStop {
+			rail.Infof("Downstream client disconnected, stopping dify chat stream")
+			stop()
+		} else {
+			rail.Infof("Downstream client disconnected, continue consuming dify chat stream")
+		}
+	}()
+	if pw.keepAliveInterval > 0 {
+		go pw.keepAlive(pw.keepAliveInterval, done)
+	}
+
+	var lastId string
+	forward := chainProxyMiddlewares(rail, conf.Middlewares, func(e SseEvent) error {
+		// proxy the sse events to downstream, LastEventID is the last non-empty id, only forward it when it changes
+		if e.LastEventID == lastId {
+			e.LastEventID = ""
+		} else {
+			lastId = e.LastEventID
+		}
+		if conf.EventName != nil {
+			if name := conf.EventName(e); name != "" {
+				e.Type = name
+			}
+		}
+		pw.send(newSseMessage(e))
+		return nil
+	})
+	onSse := req.OnSseEvent
+	req.OnSseEvent = func(e SseEvent) error {
+		if onSse != nil {
+			if err := onSse(e); err != nil {
+				return err
+			}
+		}
+		if id := taskIdOf(e.Data); id != "" {
+			taskMu.Lock()
+			taskId = id
+			taskMu.Unlock()
+		}
+		return forward(e)
+	}
+	res, err := StreamQueryChatBot(streamRail, host, apiKey, req)
+	if pw.isDisconnected() && conf.OnDisconnect == DisconnectStop {
+		return res, ErrDownstreamDisconnected.WithInternalMsg("proxy stream stopped, %v", err)
+	}
+	for _, ext := range conf.AppendSseEvents {
+		pw.send(newSseMessage(ext()))
+	}
+	return res, err
+}
+
+// Create sse.Message with event type and id, invalid type or id (e.g., containing newline) is dropped.
+func newSseMessage(e SseEvent) *sse.Message {
+	m := &sse.Message{}
+	if e.Type != "" {
+		m.Type, _ = sse.NewType(e.Type)
+	}
+	if e.LastEventID != "" {
+		m.ID, _ = sse.NewID(e.LastEventID)
+	}
+	m.AppendData(e.Data)
+	return m
+}
+
+func taskIdOf(data string) string {
+	var e struct {
+		TaskId string `json:"task_id"`
+	}
+	if err := json.SParseJson(data, &e); err != nil {
+		return ""
+	}
+	return e.TaskId
+}
+
+// Serialize writes to downstream, events are flushed immediately.
+type proxyWriter struct {
+	rail              miso.Rail
+	keepAliveInterval time.Duration
+
+	mu   sync.Mutex
+	sess *sse.Session
+	gone bool
+	last time.Time
+}
+
+func newProxyWriter(rail miso.Rail, sess *sse.Session, conf ProxyConfig) *proxyWriter {
+	return &proxyWriter{rail: rail, sess: sess, keepAliveInterval: conf.KeepAliveInterval, last: time.Now()}
+}
+
+func (p *proxyWriter) send(m *sse.Message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.gone {
+		return
+	}
+	p.last = time.Now()
+	err := p.sess.Send(m)
+	if err == nil {
+		err = p.sess.Flush()
+	}
+	if err != nil {
+		p.rail.Warnf("Failed to proxy sse event, %v", err)
+	}
+}
+
+func (p *proxyWriter) disconnect() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gone = true
+}
+
+func (p *proxyWriter) isDisconnected() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.gone
+}
+
+// Send SSE comment if the stream is idle for the given interval.
+func (p *proxyWriter) keepAlive(interval time.Duration, done chan struct{}) {
+	tk := time.NewTicker(interval / 2)
+	defer tk.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-tk.C:
+			p.mu.Lock()
+			idle := time.Since(p.last) >= interval
+			p.mu.Unlock()
+			if idle {
+				m := &sse.Message{}
+				m.AppendComment("keep-alive")
+				p.send(m)
+			}
+		}
+	}
+}
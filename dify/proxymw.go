@@ -0,0 +1,75 @@
+package dify
+
+import (
+	"slices"
+
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util/json"
+)
+
+// Event passing through the proxy middlewares.
+type ProxyEvent struct {
+	// Typed event parsed from Frame, nil if Frame is not a dify event.
+	//
+	// Event is not updated automatically when Frame is changed, use [NewProxyEvent] to parse it again if necessary.
+	Event ChatStreamEvent
+
+	// Raw frame sent to downstream.
+	Frame SseEvent
+}
+
+// Create ProxyEvent, Frame.Data is parsed as dify event.
+func NewProxyEvent(frame SseEvent) ProxyEvent {
+	e := ProxyEvent{Frame: frame}
+	var cme ChatMessageEvent
+	if err := json.SParseJson(frame.Data, &cme); err == nil && cme.Event != "" {
+		e.Event = newChatStreamEvent(cme)
+	}
+	return e
+}
+
+// Middleware of proxied events.
+//
+// The middleware may call next zero or more times to emit downstream frames, e.g., to drop, rewrite, or inject events.
+// Returning error stops the proxied stream.
+type ProxyMiddleware func(rail miso.Rail, e ProxyEvent, next func(e ProxyEvent) error) error
+
+// Chain middlewares in order, sink receives the final frames.
+func chainProxyMiddlewares(rail miso.Rail, mws []ProxyMiddleware, sink func(e SseEvent) error) func(e SseEvent) error {
+	next := func(e ProxyEvent) error { return sink(e.Frame) }
+	for i := len(mws) - 1; i >= 0; i-- {
+		mw, n := mws[i], next
+		next = func(e ProxyEvent) error { return mw(rail, e, n) }
+	}
+	return func(e SseEvent) error { return next(NewProxyEvent(e)) }
+}
+
+// Middleware that drops dify events of the given types, e.g., agent_thought.
+func DropEvents(types ...string) ProxyMiddleware {
+	return func(rail miso.Rail, e ProxyEvent, next func(e ProxyEvent) error) error {
+		if e.Event != nil && slices.Contains(types, e.Event.RawEvent().Event) {
+			return nil
+		}
+		return next(e)
+	}
+}
+
+// Middleware that rewrites the json payload of dify events, e.g., to redact or to rename fields.
+//
+// Fields unknown to [ChatMessageEvent] are preserved, return false to drop the event.
+func RewriteEventJson(f func(rail miso.Rail, m map[string]any) bool) ProxyMiddleware {
+	return func(rail miso.Rail, e ProxyEvent, next func(e ProxyEvent) error) error {
+		if e.Event == nil {
+			return next(e)
+		}
+		var m map[string]any
+		if err := json.SParseJson(e.Frame.Data, &m); err != nil {
+			return next(e)
+		}
+		if !f(rail, m) {
+			return nil
+		}
+		e.Frame.Data = json.TrySWriteJson(m)
+		return next(NewProxyEvent(e.Frame))
+	}
+}
@@ -0,0 +1,133 @@
+package dify
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/curtisnewbie/miso/miso"
+)
+
+// Token bucket rate limit.
+type RateLimit struct {
+	Rate  float64 // number of requests allowed per second, 0 means unlimited
+	Burst int     // max number of requests allowed in a burst, by default it's max(1, Rate)
+}
+
+// Client-side rate limit policy, requests are limited by api key and endpoint group (see [EndpointGroup]).
+type RateLimitPolicy struct {
+	Default RateLimit            // rate limit of endpoint groups not in Groups
+	Groups  map[string]RateLimit // rate limit of each endpoint group, e.g., GroupChat, GroupDatasetWrite
+}
+
+// Create Api that limits request rate using the RateLimitPolicy.
+//
+// Requests exceeding the limit wait until the token is available or the rail is cancelled.
+// Wait time is reported in prometheus histogram 'dify_rate_limit_wait_seconds' if 'dify.metrics.enabled' is true.
+//
+// The limiter is shared by the returned Api and all Api derived from it.
+func (a Api) WithRateLimit(p RateLimitPolicy) Api {
+	a.limiter = newRateLimiter(p)
+	return a
+}
+
+type rateLimiter struct {
+	policy RateLimitPolicy
+
+	mu      sync.Mutex
+	buckets map[rateLimitKey]*tokenBucket
+}
+
+type rateLimitKey struct {
+	apiKey string
+	group  string
+}
+
+func newRateLimiter(p RateLimitPolicy) *rateLimiter {
+	return &rateLimiter{policy: p, buckets: map[rateLimitKey]*tokenBucket{}}
+}
+
+func (l *rateLimiter) bucket(apiKey string, group string) *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	k := rateLimitKey{apiKey: apiKey, group: group}
+	if b, ok := l.buckets[k]; ok {
+		return b
+	}
+	rl, ok := l.policy.Groups[group]
+	if !ok {
+		rl = l.policy.Default
+	}
+	var b *tokenBucket
+	if rl.Rate > 0 {
+		b = newTokenBucket(rl)
+	}
+	l.buckets[k] = b
+	return b
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rl RateLimit) *tokenBucket {
+	burst := float64(rl.Burst)
+	if burst < 1 {
+		burst = max(1, rl.Rate)
+	}
+	return &tokenBucket{rate: rl.Rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Take a token, return the time to wait before the token is available.
+func (b *tokenBucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Return the reserved token that is not used.
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.burst, b.tokens+1)
+}
+
+type rateLimitTransport struct {
+	next    http.RoundTripper
+	limiter *rateLimiter
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	group := EndpointGroup(req.Method, req.URL.Path)
+	b := t.limiter.bucket(req.Header.Get("Authorization"), group)
+	if b == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	start := time.Now()
+	if wait := b.reserve(); wait > 0 {
+		select {
+		case <-req.Context().Done():
+			b.cancel()
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		miso.NewRail(req.Context()).Debugf("Dify request rate limited, group: %v, waited: %v", group, time.Since(start))
+	}
+	if metricsEnabled() {
+		initMetrics()
+		rateLimitWaitHisto.WithLabelValues(group).Observe(time.Since(start).Seconds())
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,149 @@
+package dify
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/curtisnewbie/miso/errs"
+	"github.com/curtisnewbie/miso/miso"
+)
+
+const (
+	propApiKey = "api-key"
+	propHost   = "host"
+)
+
+var (
+	ErrUnknownApp     = errs.NewErrfCode("DIFY_UNKNOWN_APP", "dify app not found")
+	ErrUnknownDataset = errs.NewErrfCode("DIFY_UNKNOWN_DATASET", "dify dataset not found")
+
+	defaultKeyRegistry = NewKeyRegistry()
+)
+
+// Api key (and optional host override) of a named dify app or dataset.
+type KeyEntry struct {
+	Name   string
+	ApiKey string
+	Host   string // host override, empty means using the Api's host
+}
+
+// Registry of named dify app and dataset keys loaded from miso configuration.
+//
+//	dify:
+//	  apps:
+//	    support-bot:
+//	      api-key: "app-xxx"
+//	      host: "http://dify-eu:5001" # optional
+//	  datasets:
+//	    manuals:
+//	      api-key: "dataset-xxx"
+//
+// The keys are reloaded from configuration lazily once RefreshInterval elapses, or explicitly using [KeyRegistry.Reload].
+//
+// Use [NewKeyRegistry] to create one, or use the default one returned by [GetKeyRegistry].
+type KeyRegistry struct {
+	RefreshInterval time.Duration // by default 10s, -1 to disable lazy reload
+
+	mu       sync.RWMutex
+	loadedAt time.Time
+	apps     map[string]KeyEntry
+	datasets map[string]KeyEntry
+}
+
+func NewKeyRegistry() *KeyRegistry {
+	return &KeyRegistry{RefreshInterval: 10 * time.Second}
+}
+
+// Get default KeyRegistry used by [Api.App] and [Api.Dataset].
+func GetKeyRegistry() *KeyRegistry {
+	return defaultKeyRegistry
+}
+
+// Reload keys from miso configuration.
+func (k *KeyRegistry) Reload() {
+	apps := loadKeyEntries(PropApps)
+	datasets := loadKeyEntries(PropDatasets)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.apps = apps
+	k.datasets = datasets
+	k.loadedAt = time.Now()
+}
+
+// Get key of named app.
+func (k *KeyRegistry) App(name string) (KeyEntry, error) {
+	k.reloadIfStale()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if e, ok := k.apps[strings.ToLower(name)]; ok {
+		return e, nil
+	}
+	return KeyEntry{}, ErrUnknownApp.WithInternalMsg("app: %v", name)
+}
+
+// Get key of named dataset.
+func (k *KeyRegistry) Dataset(name string) (KeyEntry, error) {
+	k.reloadIfStale()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if e, ok := k.datasets[strings.ToLower(name)]; ok {
+		return e, nil
+	}
+	return KeyEntry{}, ErrUnknownDataset.WithInternalMsg("dataset: %v", name)
+}
+
+// Names of the registered apps.
+func (k *KeyRegistry) AppNames() []string {
+	k.reloadIfStale()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return sortedKeys(k.apps)
+}
+
+// Names of the registered datasets.
+func (k *KeyRegistry) DatasetNames() []string {
+	k.reloadIfStale()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return sortedKeys(k.datasets)
+}
+
+func (k *KeyRegistry) reloadIfStale() {
+	k.mu.RLock()
+	stale := k.loadedAt.IsZero() || (k.RefreshInterval >= 0 && time.Since(k.loadedAt) >= k.RefreshInterval)
+	k.mu.RUnlock()
+	if stale {
+		k.Reload()
+	}
+}
+
+func loadKeyEntries(prop string) map[string]KeyEntry {
+	m := map[string]KeyEntry{}
+	for _, name := range miso.GetPropChild(prop) {
+		name = strings.ToLower(name)
+		e := KeyEntry{
+			Name:   name,
+			ApiKey: miso.GetPropStr(fmt.Sprintf("%v.%v.%v", prop, name, propApiKey)),
+			Host:   strings.TrimSuffix(miso.GetPropStr(fmt.Sprintf("%v.%v.%v", prop, name, propHost)), "/"),
+		}
+		if e.ApiKey == "" {
+			miso.Warnf("Missing api key for %v.%v, ignored", prop, name)
+			continue
+		}
+		m[name] = e
+	}
+	return m
+}
+
+func sortedKeys(m map[string]KeyEntry) []string {
+	l := make([]string, 0, len(m))
+	for k := range m {
+		l = append(l, k)
+	}
+	sort.Strings(l)
+	return l
+}
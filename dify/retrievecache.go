@@ -0,0 +1,193 @@
+package dify
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util/json"
+)
+
+// Storage of RetrieveCache, e.g., [NewMemRetrieveCacheStore], or difyredis.NewRetrieveCacheStore for redis.
+//
+// Each dataset has a version that is bumped on invalidation, the version is part of the cache key, so the entries of
+// the older versions are simply never read again and left to expire.
+type RetrieveCacheStore interface {
+	Get(rail miso.Rail, key string) (RetrieveRes, bool, error)
+	Put(rail miso.Rail, key string, res RetrieveRes, ttl time.Duration) error
+	Version(rail miso.Rail, datasetId string) (int64, error)
+	BumpVersion(rail miso.Rail, datasetId string) error
+}
+
+// Cache of [Retrieve], use [Api.WithRetrieveCache] to enable it.
+//
+// Entries are keyed by api key, dataset, normalized query and retrieval model. The cache of a dataset is invalidated when
+// document or segment of the dataset is changed using this package with the same Api, e.g., [AddDocumentSegment],
+// [RemoveDocument]. Changes made elsewhere are only seen after TTL elapses, or after [RetrieveCache.Invalidate] is called.
+// Uploaded documents are indexed asynchronously, call [RetrieveCache.Invalidate] once indexing completes if necessary.
+//
+// Cached RetrieveRes is shared between callers, it should not be modified.
+//
+// Errors of RetrieveCacheStore are logged, and the call falls back to dify.
+type RetrieveCache struct {
+	Store          RetrieveCacheStore
+	TTL            time.Duration         // by default 'dify.retrieve-cache.ttl'
+	NormalizeQuery func(q string) string // by default, spaces are trimmed and collapsed, and the query is lower-cased
+}
+
+func NewRetrieveCache(store RetrieveCacheStore) *RetrieveCache {
+	return &RetrieveCache{Store: store, TTL: miso.GetPropDuration(PropRetrieveCacheTTL), NormalizeQuery: normalizeRetrieveQuery}
+}
+
+func normalizeRetrieveQuery(q string) string {
+	return strings.ToLower(strings.Join(strings.Fields(q), " "))
+}
+
+// Enable cache of [Retrieve].
+func (a Api) WithRetrieveCache(c *RetrieveCache) Api {
+	a.retrieveCache = c
+	return a
+}
+
+// Retrieve cache of the Api, nil if it's not configured.
+func (a Api) RetrieveCache() *RetrieveCache {
+	return a.retrieveCache
+}
+
+// Invalidate cached records of the dataset.
+func (c *RetrieveCache) Invalidate(rail miso.Rail, datasetId string) error {
+	return c.Store.BumpVersion(rail, datasetId)
+}
+
+func (c *RetrieveCache) key(apiKey string, datasetId string, version int64, req RetrieveReq) string {
+	q := req.Query
+	if c.NormalizeQuery != nil {
+		q = c.NormalizeQuery(q)
+	}
+	h := sha256.Sum256([]byte(apiKey + "\n" + q + "\n" + json.TrySWriteJson(req.RetrievalModel)))
+	return fmt.Sprintf("%v:%v:%v", datasetId, version, hex.EncodeToString(h[:]))
+}
+
+func (c *RetrieveCache) retrieve(rail miso.Rail, apiKey string, datasetId string, req RetrieveReq,
+	load func() (RetrieveRes, error)) (RetrieveRes, error) {
+
+	// version is read before load, so that the records loaded concurrently with invalidation are cached under the stale version
+	ver, err := c.Store.Version(rail, datasetId)
+	if err != nil {
+		rail.Warnf("Failed to read retrieve cache version of dataset %v, %v", datasetId, err)
+		return load()
+	}
+	key := c.key(apiKey, datasetId, ver, req)
+	if res, ok, err := c.Store.Get(rail, key); err != nil {
+		rail.Warnf("Failed to read retrieve cache of dataset %v, %v", datasetId, err)
+	} else if ok {
+		rail.Debugf("Retrieve cache hit, dataset: %v, query: %v", datasetId, req.Query)
+		return res, nil
+	}
+
+	res, err := load()
+	if err != nil {
+		return res, err
+	}
+	if err := c.Store.Put(rail, key, res, c.TTL); err != nil {
+		rail.Warnf("Failed to write retrieve cache of dataset %v, %v", datasetId, err)
+	}
+	return res, nil
+}
+
+func retrieveCacheOf(rail miso.Rail) *RetrieveCache {
+	if a, ok := rail.Context().Value(apiCtxKey{}).(Api); ok {
+		return a.retrieveCache
+	}
+	return nil
+}
+
+// Invalidate retrieve cache of the dataset after it's changed.
+func invalidateRetrieveCache(rail miso.Rail, datasetId string) {
+	c := retrieveCacheOf(rail)
+	if c == nil || datasetId == "" {
+		return
+	}
+	if err := c.Invalidate(rail, datasetId); err != nil {
+		rail.Warnf("Failed to invalidate retrieve cache of dataset %v, %v", datasetId, err)
+	}
+}
+
+type memRetrieveCacheStore struct {
+	size int
+
+	mu       sync.Mutex
+	ll       *list.List // most recently used at front
+	entries  map[string]*list.Element
+	versions map[string]int64
+}
+
+type memRetrieveCacheEntry struct {
+	key      string
+	res      RetrieveRes
+	expireAt time.Time
+}
+
+// Create in-memory LRU RetrieveCacheStore, size is the max number of entries, by default 'dify.retrieve-cache.size'.
+func NewMemRetrieveCacheStore(size int) RetrieveCacheStore {
+	if size < 1 {
+		size = miso.GetPropInt(PropRetrieveCacheSize)
+	}
+	return &memRetrieveCacheStore{size: size, ll: list.New(), entries: map[string]*list.Element{}, versions: map[string]int64{}}
+}
+
+func (s *memRetrieveCacheStore) Get(rail miso.Rail, key string) (RetrieveRes, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[key]
+	if !ok {
+		return RetrieveRes{}, false, nil
+	}
+	e := el.Value.(*memRetrieveCacheEntry)
+	if !e.expireAt.IsZero() && time.Now().After(e.expireAt) {
+		s.ll.Remove(el)
+		delete(s.entries, key)
+		return RetrieveRes{}, false, nil
+	}
+	s.ll.MoveToFront(el)
+	return e.res, true, nil
+}
+
+func (s *memRetrieveCacheStore) Put(rail miso.Rail, key string, res RetrieveRes, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := &memRetrieveCacheEntry{key: key, res: res}
+	if ttl > 0 {
+		e.expireAt = time.Now().Add(ttl)
+	}
+	if el, ok := s.entries[key]; ok {
+		el.Value = e
+		s.ll.MoveToFront(el)
+		return nil
+	}
+	s.entries[key] = s.ll.PushFront(e)
+	for s.ll.Len() > s.size {
+		last := s.ll.Back()
+		s.ll.Remove(last)
+		delete(s.entries, last.Value.(*memRetrieveCacheEntry).key)
+	}
+	return nil
+}
+
+func (s *memRetrieveCacheStore) Version(rail miso.Rail, datasetId string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.versions[datasetId], nil
+}
+
+func (s *memRetrieveCacheStore) BumpVersion(rail miso.Rail, datasetId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.versions[datasetId]++
+	return nil
+}
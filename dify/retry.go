@@ -0,0 +1,151 @@
+package dify
+
+import (
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/curtisnewbie/miso/miso"
+)
+
+var (
+	// Status codes that are retried, e.g., returned during dify deployments.
+	RetryStatusCodes = []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+)
+
+// Retry policy of dify api calls.
+//
+// Only idempotent calls (see [Idempotent]) are retried, unless RetryNonIdempotent is true.
+type RetryPolicy struct {
+	MaxAttempts        int           // max number of attempts including the first one, by default 3
+	Backoff            time.Duration // backoff before the first retry, doubled on each retry, by default 500ms
+	MaxBackoff         time.Duration // max backoff, if Retry-After is longer than MaxBackoff, the response is returned without retry, by default 10s
+	Jitter             float64       // random jitter in ratio of the backoff, e.g., 0.2 means +-20%, by default 0.2, -1 to disable jitter
+	RetryNonIdempotent bool          // also retry non-idempotent calls, e.g., chat, workflow and UploadDocument
+}
+
+// Create default RetryPolicy.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: 3, Backoff: 500 * time.Millisecond, MaxBackoff: 10 * time.Second, Jitter: 0.2}
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	d := DefaultRetryPolicy()
+	if p.MaxAttempts < 1 {
+		p.MaxAttempts = d.MaxAttempts
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = d.Backoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = d.MaxBackoff
+	}
+	if p.Jitter == 0 {
+		p.Jitter = d.Jitter
+	} else if p.Jitter < 0 {
+		p.Jitter = 0
+	}
+	return p
+}
+
+// Create Api that retries failed calls using the RetryPolicy.
+func (a Api) WithRetry(p RetryPolicy) Api {
+	p = p.withDefaults()
+	a.retry = &p
+	return a
+}
+
+type retryTransport struct {
+	next   http.RoundTripper
+	policy RetryPolicy
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	p := t.policy
+	if !p.RetryNonIdempotent && !Idempotent(req.Method, req.URL.Path) {
+		return t.next.RoundTrip(req)
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return t.next.RoundTrip(req) // body can't be replayed
+	}
+
+	backoff := p.Backoff
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := t.next.RoundTrip(req)
+		if attempt >= p.MaxAttempts || req.Context().Err() != nil || errors.Is(err, ErrCircuitOpen) {
+			return resp, err
+		}
+
+		var wait time.Duration
+		if err != nil {
+			wait = jitter(backoff, p.Jitter)
+		} else if retryStatus(resp.StatusCode) {
+			if ra, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				if ra > p.MaxBackoff {
+					return resp, nil
+				}
+				wait = ra
+			} else {
+				wait = jitter(backoff, p.Jitter)
+			}
+		} else {
+			return resp, nil
+		}
+
+		if err != nil {
+			miso.NewRail(req.Context()).Warnf("Dify request failed, %v %v, attempt: %v, retry in %v, %v", req.Method, req.URL.Path, attempt, wait, err)
+		} else {
+			miso.NewRail(req.Context()).Warnf("Dify request failed, %v %v, status: %v, attempt: %v, retry in %v", req.Method, req.URL.Path, resp.StatusCode, attempt, wait)
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, p.MaxBackoff)
+	}
+}
+
+func retryStatus(code int) bool {
+	for _, c := range RetryStatusCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func jitter(d time.Duration, ratio float64) time.Duration {
+	if ratio <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + ratio*(rand.Float64()*2-1)))
+}
+
+// Parse Retry-After header, either in seconds or in http date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if sec, err := strconv.Atoi(v); err == nil {
+		return max(time.Duration(sec)*time.Second, 0), true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
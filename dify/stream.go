@@ -0,0 +1,165 @@
+package dify
+
+import (
+	"context"
+	"iter"
+	"time"
+
+	"github.com/curtisnewbie/miso/errs"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util/json"
+	"github.com/tmaxmax/go-sse"
+)
+
+var (
+	// Timeout of the stop request sent when the chat stream is terminated early.
+	StopChatTimeout = 5 * time.Second
+)
+
+// Event of chat stream, use type switch to handle the concrete events, i.e.,
+// [ChatMessageChunk], [ChatAgentThought], [ChatMessageEnd], [ChatWorkflowEvent], [ChatErrorEvent] and [ChatOtherEvent].
+type ChatStreamEvent interface {
+	// Raw event received from dify.
+	RawEvent() ChatMessageEvent
+}
+
+// Chunk of answer, i.e., message or agent_message event.
+type ChatMessageChunk struct{ ChatMessageEvent }
+
+// Agent thought, i.e., agent_thought event.
+type ChatAgentThought struct{ ChatMessageEvent }
+
+// End of message, i.e., message_end event, usage and retriever resources are available in Metadata.
+type ChatMessageEnd struct{ ChatMessageEvent }
+
+// Progress of chatflow, i.e., workflow_started, node_started, node_finished and workflow_finished event.
+type ChatWorkflowEvent struct{ ChatMessageEvent }
+
+// Error event, the stream ends after it.
+type ChatErrorEvent struct {
+	ChatMessageEvent
+	Err *DifyError
+}
+
+// Events not covered by the other types, e.g., message_file, message_replace, tts_message.
+type ChatOtherEvent struct{ ChatMessageEvent }
+
+func (e ChatMessageChunk) RawEvent() ChatMessageEvent  { return e.ChatMessageEvent }
+func (e ChatAgentThought) RawEvent() ChatMessageEvent  { return e.ChatMessageEvent }
+func (e ChatMessageEnd) RawEvent() ChatMessageEvent    { return e.ChatMessageEvent }
+func (e ChatWorkflowEvent) RawEvent() ChatMessageEvent { return e.ChatMessageEvent }
+func (e ChatErrorEvent) RawEvent() ChatMessageEvent    { return e.ChatMessageEvent }
+func (e ChatOtherEvent) RawEvent() ChatMessageEvent    { return e.ChatMessageEvent }
+
+func newChatStreamEvent(e ChatMessageEvent) ChatStreamEvent {
+	switch e.Event {
+	case EventTypeMessage, EventTypeAgentMessage:
+		return ChatMessageChunk{e}
+	case EventTypeAgentThrought:
+		return ChatAgentThought{e}
+	case EventTypeMessageEnd:
+		return ChatMessageEnd{e}
+	case EventWorkflowStarted, EventNodeStarted, EventNodeFinished, EventWorkflowFinished:
+		return ChatWorkflowEvent{e}
+	case EventTypeError:
+		return ChatErrorEvent{ChatMessageEvent: e, Err: &DifyError{Code: e.Code, Message: e.Message, Status: e.Status}}
+	}
+	return ChatOtherEvent{e}
+}
+
+// Stream chat message events as an iterator.
+//
+// The events are read from the response body only when the loop body asks for the next one, a slow consumer thus slows down
+// the reading instead of buffering the events in memory.
+//
+// Breaking the loop (or cancelling the rail) before the message ends closes the response body and stops the dify task.
+//
+// The request is sent each time the iterator is ranged over. Errors end the iteration, an error event is yielded
+// together with the mapped error, e.g.,
+//
+//	for e, err := range dify.StreamChat(rail, host, apiKey, req) {
+//		if err != nil {
+//			return err
+//		}
+//		switch e := e.(type) {
+//		case dify.ChatMessageChunk:
+//			fmt.Print(e.Answer)
+//		case dify.ChatMessageEnd:
+//			usage = e.Metadata.Usage
+//		}
+//	}
+func StreamChat(rail miso.Rail, host string, apiKey string, req ChatMessageReq) iter.Seq2[ChatStreamEvent, error] {
+	return func(yield func(ChatStreamEvent, error) bool) {
+		cr := prepareChatReq(req).(ChatMessageReq)
+
+		var (
+			taskId   string
+			finished bool
+			broken   bool
+			errCode  string
+		)
+		sm := startStreamMetrics(rail, "StreamChat")
+		rail, span := startStreamSpan(rail, "StreamChat")
+		defer span.End()
+
+		err := newClient(rail, host+ChatMessageUrl).
+			Require2xx().
+			AddAuthBearer(apiKey).
+			PostJson(cr).
+			Sse(func(e sse.Event) (stop bool, err error) {
+				if e.Data == "" {
+					return false, nil
+				}
+				var cme ChatMessageEvent
+				if err := json.SParseJson(e.Data, &cme); err != nil {
+					return true, errs.Wrapf(err, "parse streaming event failed, %v", e.Data)
+				}
+				sm.event(cme.Event, cme.Code, cme.Status)
+				span.event(cme)
+				if cme.TaskId != "" {
+					taskId = cme.TaskId
+				}
+
+				ev := newChatStreamEvent(cme)
+				var evErr error
+				switch ev := ev.(type) {
+				case ChatMessageEnd:
+					finished = true
+				case ChatErrorEvent:
+					finished = true
+					errCode = cme.Code
+					evErr = ev.Err.MisoErr().Wrapf(ev.Err, "dify.StreamChat failed")
+					span.RecordError(ev.Err)
+				}
+				if !yield(ev, evErr) {
+					broken = true
+					return true, nil
+				}
+				return evErr != nil, nil
+			}, func(c *miso.SseReadConfig) { c.MaxEventSize = 512 * 1024 })
+
+		if err != nil && errCode == "" {
+			errCode = "stream_error"
+		}
+		sm.end(errCode)
+
+		if !finished && taskId != "" && (broken || rail.IsDone()) {
+			stopChatTask(rail, host, apiKey, StopChatMessageReq{TaskId: taskId, User: cr.User})
+		}
+		if err != nil && !broken {
+			span.RecordError(err)
+			yield(nil, wrapDifyErr(err, "dify.StreamChat failed"))
+		}
+	}
+}
+
+// Stop dify task even if the rail is cancelled.
+func stopChatTask(rail miso.Rail, host string, apiKey string, req StopChatMessageReq) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(rail.Context()), StopChatTimeout)
+	defer cancel()
+	if err := StopChatMessage(miso.NewRail(ctx), host, apiKey, req); err != nil {
+		rail.Warnf("Failed to stop dify chat task, %v", err)
+		return
+	}
+	rail.Infof("Stopped dify chat task: %v", req.TaskId)
+}
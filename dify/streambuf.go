@@ -0,0 +1,307 @@
+package dify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/curtisnewbie/miso/errs"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util/randutil"
+	"github.com/tmaxmax/go-sse"
+)
+
+var (
+	ErrStreamNotFound = errs.NewErrfCode("DIFY_STREAM_NOT_FOUND", "Stream is expired, please try again")
+
+	defaultStreamBuffer     *StreamBuffer
+	defaultStreamBufferOnce sync.Once
+)
+
+// Buffer of proxied chat streams, so that the client can reconnect with Last-Event-ID and replay the missed events.
+//
+// Each buffered event is assigned an id in the form of '<stream_key>:<seq>', where seq starts from 1.
+// The dify stream is always consumed to completion, and is kept in memory until TTL elapses after the stream ends.
+// The buffer is bounded by MaxStreams and MaxEvents, and the stream that has not ended within MaxLifetime is evicted.
+// Streams are evicted lazily when the buffer is accessed, and the dify stream is cancelled if it's evicted before it ends.
+//
+// Use [NewStreamBuffer] to create one, or use the default one returned by [GetStreamBuffer].
+type StreamBuffer struct {
+	TTL         time.Duration // how long the stream is kept after it ends, by default 5m
+	MaxStreams  int           // max number of streams, the oldest ones are evicted first, by default 1000, <= 0 means no limit
+	MaxEvents   int           // max number of events of each stream, the oldest ones are dropped first, by default 10000, <= 0 means no limit
+	MaxLifetime time.Duration // max lifetime of the stream that has not ended, by default 30m, <= 0 means no limit
+
+	mu      sync.Mutex
+	streams map[string]*bufferedStream
+}
+
+func NewStreamBuffer() *StreamBuffer {
+	return &StreamBuffer{TTL: 5 * time.Minute, MaxStreams: 1000, MaxEvents: 10000, MaxLifetime: 30 * time.Minute,
+		streams: map[string]*bufferedStream{}}
+}
+
+// Get default StreamBuffer used when 'dify.proxy.buffer.enabled' is true.
+func GetStreamBuffer() *StreamBuffer {
+	defaultStreamBufferOnce.Do(func() {
+		defaultStreamBuffer = NewStreamBuffer()
+		defaultStreamBuffer.TTL = miso.GetPropDuration(PropProxyBufferTTL)
+		defaultStreamBuffer.MaxStreams = miso.GetPropInt(PropProxyBufferMaxStreams)
+		defaultStreamBuffer.MaxEvents = miso.GetPropInt(PropProxyBufferMaxEvents)
+		defaultStreamBuffer.MaxLifetime = miso.GetPropDuration(PropProxyBufferMaxLifetime)
+	})
+	return defaultStreamBuffer
+}
+
+// Number of streams in the buffer, including the ended ones that are not yet expired.
+func (b *StreamBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.evict()
+	return len(b.streams)
+}
+
+// Create stream, cancel is called if the stream is evicted before it ends.
+func (b *StreamBuffer) create(user string, cancel func()) *bufferedStream {
+	s := &bufferedStream{key: randutil.RandLowerAlphaNumeric(24), user: user, createdAt: time.Now(), maxEvents: b.MaxEvents,
+		cancel: cancel, notify: make(chan struct{})}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.evict()
+	for b.MaxStreams > 0 && len(b.streams) >= b.MaxStreams {
+		var oldest *bufferedStream
+		for _, v := range b.streams {
+			if oldest == nil || v.createdAt.Before(oldest.createdAt) {
+				oldest = v
+			}
+		}
+		b.remove(oldest)
+	}
+	b.streams[s.key] = s
+	return s
+}
+
+func (b *StreamBuffer) get(key string) (*bufferedStream, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.evict()
+	s, ok := b.streams[key]
+	return s, ok
+}
+
+func (b *StreamBuffer) evict() {
+	for _, s := range b.streams {
+		if s.expired(b.TTL, b.MaxLifetime) {
+			b.remove(s)
+		}
+	}
+}
+
+func (b *StreamBuffer) remove(s *bufferedStream) {
+	delete(b.streams, s.key)
+	if !s.ended() {
+		miso.Warnf("Evicted buffered dify chat stream %v before it ends, cancelling the stream", s.key)
+		s.cancel()
+	}
+}
+
+type bufferedStream struct {
+	key       string
+	user      string
+	createdAt time.Time
+	maxEvents int
+	cancel    func()
+
+	mu      sync.Mutex
+	events  []SseEvent
+	dropped int           // number of the oldest events dropped due to maxEvents
+	notify  chan struct{} // closed and replaced when events are appended or the stream ends
+	done    bool
+	endAt   time.Time
+	res     ChatMessageRes
+	err     error
+}
+
+func (s *bufferedStream) append(e SseEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.LastEventID = fmt.Sprintf("%v:%v", s.key, s.dropped+len(s.events)+1)
+	if s.maxEvents > 0 && len(s.events) >= s.maxEvents {
+		s.events[0] = SseEvent{}
+		s.events = s.events[1:]
+		s.dropped++
+	}
+	s.events = append(s.events, e)
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+func (s *bufferedStream) finish(res ChatMessageRes, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done = true
+	s.endAt = time.Now()
+	s.res, s.err = res, err
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// Events after seq, whether the stream is ended, and the channel notified when there are more events.
+//
+// ok is false if some of the events after seq are already dropped.
+func (s *bufferedStream) since(seq int) (l []SseEvent, done bool, notify <-chan struct{}, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq < s.dropped {
+		return nil, s.done, s.notify, false
+	}
+	if i := seq - s.dropped; i < len(s.events) {
+		l = s.events[i:]
+	}
+	return l, s.done, s.notify, true
+}
+
+func (s *bufferedStream) ended() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done
+}
+
+func (s *bufferedStream) result() (ChatMessageRes, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.res, s.err
+}
+
+func (s *bufferedStream) expired(ttl time.Duration, maxLifetime time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return time.Since(s.endAt) >= ttl
+	}
+	return maxLifetime > 0 && time.Since(s.createdAt) >= maxLifetime
+}
+
+// Parse event id '<stream_key>:<seq>'.
+func parseBufferedEventId(id string) (key string, seq int, ok bool) {
+	key, n, ok := strings.Cut(id, ":")
+	if !ok || key == "" {
+		return "", 0, false
+	}
+	seq, err := strconv.Atoi(n)
+	if err != nil || seq < 0 {
+		return "", 0, false
+	}
+	return key, seq, true
+}
+
+// Proxy chat stream through StreamBuffer.
+//
+// If the request carries Last-Event-ID of a buffered stream, the missed events are replayed and the stream continues live,
+// the returned ChatMessageRes is marked Resumed. Otherwise, a new chat is started, and the call returns once dify's stream ends.
+func proxyBufferedChat(rail miso.Rail, host string, apiKey string, req ChatMessageReq, w http.ResponseWriter, r *http.Request,
+	conf ProxyConfig) (ChatMessageRes, error) {
+
+	sess, err := sse.Upgrade(w, r)
+	if err != nil {
+		return ChatMessageRes{}, err
+	}
+
+	if lastId := r.Header.Get("Last-Event-ID"); lastId != "" {
+		key, seq, ok := parseBufferedEventId(lastId)
+		if !ok {
+			return ChatMessageRes{}, ErrStreamNotFound.WithInternalMsg("invalid Last-Event-ID: %v", lastId)
+		}
+		bs, ok := conf.Buffer.get(key)
+		if !ok || bs.user != req.User {
+			return ChatMessageRes{}, ErrStreamNotFound.WithInternalMsg("stream not found, Last-Event-ID: %v", lastId)
+		}
+		if _, _, _, ok := bs.since(seq); !ok {
+			return ChatMessageRes{}, ErrStreamNotFound.WithInternalMsg("events are dropped, Last-Event-ID: %v", lastId)
+		}
+		rail.Infof("Resuming buffered dify chat stream %v after event %v", key, seq)
+		followBufferedStream(r, newProxyWriter(rail, sess, conf), bs, seq)
+		res, err := bs.result()
+		res.Resumed = true
+		return res, err
+	}
+
+	// the stream is consumed to completion regardless of the downstream client, unless it's evicted from the buffer
+	ctx, cancel := context.WithCancel(context.WithoutCancel(rail.Context()))
+	defer cancel()
+	streamRail := miso.NewRail(ctx)
+	bs := conf.Buffer.create(req.User, cancel)
+
+	forward := chainProxyMiddlewares(rail, conf.Middlewares, func(e SseEvent) error {
+		if conf.EventName != nil {
+			if name := conf.EventName(e); name != "" {
+				e.Type = name
+			}
+		}
+		bs.append(e)
+		return nil
+	})
+	onSse := req.OnSseEvent
+	req.OnSseEvent = func(e SseEvent) error {
+		if onSse != nil {
+			if err := onSse(e); err != nil {
+				return err
+			}
+		}
+		return forward(e)
+	}
+	go func() {
+		res, err := StreamQueryChatBot(streamRail, host, apiKey, req)
+		for _, ext := range conf.AppendSseEvents {
+			bs.append(ext())
+		}
+		bs.finish(res, err)
+	}()
+
+	followBufferedStream(r, newProxyWriter(rail, sess, conf), bs, 0)
+
+	// wait for the stream to end even if the client is gone
+	for {
+		_, done, notify, _ := bs.since(0)
+		if done {
+			break
+		}
+		<-notify
+	}
+	return bs.result()
+}
+
+// Send buffered events after seq to downstream until the stream ends or the client disconnects.
+func followBufferedStream(r *http.Request, pw *proxyWriter, bs *bufferedStream, seq int) {
+	done := make(chan struct{})
+	defer close(done)
+	defer pw.disconnect()
+	if pw.keepAliveInterval > 0 {
+		go pw.keepAlive(pw.keepAliveInterval, done)
+	}
+
+	for {
+		events, ended, notify, ok := bs.since(seq)
+		if !ok {
+			pw.rail.Warnf("Downstream client is too slow, events of dify chat stream %v are already dropped", bs.key)
+			return
+		}
+		for _, e := range events {
+			pw.send(newSseMessage(e))
+			seq++
+		}
+		if ended {
+			return
+		}
+		select {
+		case <-notify:
+		case <-r.Context().Done():
+			pw.rail.Infof("Downstream client disconnected, dify chat stream %v is still buffered", bs.key)
+			return
+		}
+	}
+}
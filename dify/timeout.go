@@ -0,0 +1,94 @@
+package dify
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/curtisnewbie/miso/errs"
+	"github.com/curtisnewbie/miso/miso"
+)
+
+// Create Api with timeouts, including the time spent on reading response body.
+//
+// streamTimeout is used for chat and workflow requests, which are usually streamed using SSE,
+// while timeout is used for the other requests. Zero means no timeout.
+func (a Api) WithTimeout(timeout time.Duration, streamTimeout time.Duration) Api {
+	a.timeout = timeout
+	a.streamTimeout = streamTimeout
+	return a
+}
+
+// Create Api that sends requests through the http proxy, e.g., http://proxy:3128.
+func (a Api) WithHttpProxy(proxyUrl string) (Api, error) {
+	u, err := url.Parse(proxyUrl)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return a, errs.NewErrf("invalid http proxy url: '%v'", proxyUrl)
+	}
+	t, ok := miso.MisoDefaultClient.Transport.(*http.Transport)
+	if !ok {
+		t = http.DefaultTransport.(*http.Transport)
+	}
+	t = t.Clone()
+	t.Proxy = http.ProxyURL(u)
+	a.base = t
+	return a, nil
+}
+
+// Ping dify host, i.e., GET /health.
+func (a Api) Ping(rail miso.Rail) error {
+	rail = a.bind(rail)
+	err := newClient(rail, a.host()+"/health").
+		Require2xx().
+		Get().
+		Ok()
+	if err != nil {
+		return wrapDifyErr(err, "failed to ping dify")
+	}
+	return nil
+}
+
+func isStreamEndpoint(method string, path string) bool {
+	return method == http.MethodPost && (path == "/v1/chat-messages" || strings.HasPrefix(path, "/v1/workflows/run"))
+}
+
+type timeoutTransport struct {
+	next          http.RoundTripper
+	timeout       time.Duration
+	streamTimeout time.Duration
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timeout := t.timeout
+	if isStreamEndpoint(req.Method, req.URL.Path) {
+		timeout = t.streamTimeout
+	}
+	if timeout <= 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return resp, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.cancel)
+	return err
+}
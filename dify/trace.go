@@ -0,0 +1,292 @@
+package dify
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/curtisnewbie/miso/miso"
+)
+
+// Span attribute keys, following OpenTelemetry semantic conventions where applicable.
+const (
+	AttrOperation      = "dify.operation"
+	AttrApp            = "dify.app"
+	AttrConversationId = "dify.conversation_id"
+	AttrMessageId      = "dify.message_id"
+	AttrTaskId         = "dify.task_id"
+	AttrWorkflowRunId  = "dify.workflow_run_id"
+	AttrDatasetId      = "dify.dataset_id"
+	AttrDocumentId     = "dify.document_id"
+	AttrNodeId         = "dify.node_id"
+	AttrNodeType       = "dify.node_type"
+	AttrNodeTitle      = "dify.node_title"
+	AttrNodeStatus     = "dify.node_status"
+	AttrErrorCode      = "dify.error_code"
+	AttrPromptTokens   = "gen_ai.usage.input_tokens"
+	AttrOutputTokens   = "gen_ai.usage.output_tokens"
+	AttrTotalTokens    = "dify.usage.total_tokens"
+	AttrHttpMethod     = "http.request.method"
+	AttrHttpStatus     = "http.response.status_code"
+	AttrUrlPath        = "url.path"
+	AttrServerAddress  = "server.address"
+
+	SpanEventFirstToken   = "first_token"
+	SpanEventNodeStarted  = EventNodeStarted
+	SpanEventNodeFinished = EventNodeFinished
+	SpanEventError        = "error"
+)
+
+var (
+	tracerMu sync.RWMutex
+	tracer   Tracer
+)
+
+type Attr struct {
+	Key   string
+	Value any
+}
+
+func NewAttr(k string, v any) Attr {
+	return Attr{Key: k, Value: v}
+}
+
+// Span of a dify operation.
+//
+// The methods are modeled after OpenTelemetry's trace.Span, so that an OpenTelemetry tracer can be adapted easily.
+type Span interface {
+	SetAttributes(attrs ...Attr)
+	AddEvent(name string, attrs ...Attr)
+	RecordError(err error)
+	End()
+}
+
+// Tracer that creates spans for dify operations.
+//
+// E.g., to adapt OpenTelemetry tracer:
+//
+//	func (t OtelTracer) Start(rail miso.Rail, name string, attrs ...dify.Attr) (miso.Rail, dify.Span) {
+//		ctx, s := t.tracer.Start(rail.Context(), name, trace.WithAttributes(toKeyValues(attrs)...))
+//		return miso.NewRail(ctx), OtelSpan{s}
+//	}
+type Tracer interface {
+	Start(rail miso.Rail, name string, attrs ...Attr) (miso.Rail, Span)
+}
+
+// Change the Tracer used by every call in this package, tracing is disabled by default.
+//
+// E.g., SetTracer(LogTracer{}) to log the spans. Pass nil to disable tracing.
+func SetTracer(t Tracer) {
+	tracerMu.Lock()
+	defer tracerMu.Unlock()
+	tracer = t
+}
+
+func tracingEnabled() bool {
+	tracerMu.RLock()
+	defer tracerMu.RUnlock()
+	return tracer != nil
+}
+
+func startSpan(rail miso.Rail, name string, attrs ...Attr) (miso.Rail, Span) {
+	tracerMu.RLock()
+	t := tracer
+	tracerMu.RUnlock()
+	if t == nil {
+		return rail, noopSpan{}
+	}
+	return t.Start(rail, name, attrs...)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(attrs ...Attr)         {}
+func (noopSpan) AddEvent(name string, attrs ...Attr) {}
+func (noopSpan) RecordError(err error)               {}
+func (noopSpan) End()                                {}
+
+// Tracer that logs spans using miso.Rail at debug level (or warn level for failed spans).
+//
+// Each span is assigned a new span id, the parent span id is logged as well.
+type LogTracer struct{}
+
+func (LogTracer) Start(rail miso.Rail, name string, attrs ...Attr) (miso.Rail, Span) {
+	parent := rail.SpanId()
+	rail = rail.WithSpanId(miso.NewSpanId())
+	return rail, &logSpan{rail: rail, name: name, parent: parent, start: time.Now(), attrs: attrs}
+}
+
+type logSpanEvent struct {
+	name  string
+	at    time.Duration
+	attrs []Attr
+}
+
+type logSpan struct {
+	rail   miso.Rail
+	name   string
+	parent string
+	start  time.Time
+
+	mu     sync.Mutex
+	attrs  []Attr
+	events []logSpanEvent
+	err    error
+	ended  bool
+}
+
+func (s *logSpan) SetAttributes(attrs ...Attr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+func (s *logSpan) AddEvent(name string, attrs ...Attr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, logSpanEvent{name: name, at: time.Since(s.start), attrs: attrs})
+}
+
+func (s *logSpan) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+	s.events = append(s.events, logSpanEvent{name: SpanEventError, at: time.Since(s.start), attrs: []Attr{NewAttr("exception.message", err.Error())}})
+}
+
+func (s *logSpan) End() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.ended = true
+
+	var b strings.Builder
+	for _, e := range s.events {
+		fmt.Fprintf(&b, "\n  +%v %v %v", e.at, e.name, formatAttrs(e.attrs))
+	}
+	if s.err != nil {
+		s.rail.Warnf("Span '%v' failed, parent: %v, took: %v, attributes: %v, events: %v", s.name, s.parent, time.Since(s.start), formatAttrs(s.attrs), b.String())
+		return
+	}
+	s.rail.Debugf("Span '%v', parent: %v, took: %v, attributes: %v, events: %v", s.name, s.parent, time.Since(s.start), formatAttrs(s.attrs), b.String())
+}
+
+func formatAttrs(attrs []Attr) string {
+	var b strings.Builder
+	b.WriteString("{")
+	for i, a := range attrs {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%v: %v", a.Key, a.Value)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+type traceTransport struct {
+	next http.RoundTripper
+	app  string
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	op := Operation(req.Method, req.URL.Path)
+	attrs := []Attr{
+		NewAttr(AttrOperation, op),
+		NewAttr(AttrHttpMethod, req.Method),
+		NewAttr(AttrUrlPath, req.URL.Path),
+		NewAttr(AttrServerAddress, req.URL.Host),
+	}
+	if t.app != "" {
+		attrs = append(attrs, NewAttr(AttrApp, t.app))
+	}
+	attrs = append(attrs, pathAttrs(req.URL.Path)...)
+
+	rail, span := startSpan(miso.NewRail(req.Context()), "dify.http "+op, attrs...)
+	resp, err := t.next.RoundTrip(req.WithContext(rail.Context()))
+	if err != nil {
+		span.RecordError(err)
+	} else {
+		span.SetAttributes(NewAttr(AttrHttpStatus, resp.StatusCode))
+		if resp.StatusCode >= 400 {
+			code := peekErrCode(resp)
+			span.SetAttributes(NewAttr(AttrErrorCode, code))
+			if resp.StatusCode >= 500 {
+				span.RecordError(fmt.Errorf("dify responded %v %v", resp.StatusCode, code))
+			}
+		}
+	}
+	span.End()
+	return resp, err
+}
+
+// Extract ids in path as span attributes, e.g., dataset_id, document_id, task_id.
+func pathAttrs(p string) []Attr {
+	var attrs []Attr
+	seg := strings.Split(strings.Trim(p, "/"), "/")
+	for i := 0; i+1 < len(seg); i++ {
+		switch seg[i] {
+		case "datasets":
+			attrs = append(attrs, NewAttr(AttrDatasetId, seg[i+1]))
+		case "documents":
+			if seg[i+1] != "metadata" {
+				attrs = append(attrs, NewAttr(AttrDocumentId, seg[i+1]))
+			}
+		case "chat-messages":
+			attrs = append(attrs, NewAttr(AttrTaskId, seg[i+1]))
+		case "messages":
+			attrs = append(attrs, NewAttr(AttrMessageId, seg[i+1]))
+		case "conversations":
+			attrs = append(attrs, NewAttr(AttrConversationId, seg[i+1]))
+		}
+	}
+	return attrs
+}
+
+// Span of a chat stream.
+type streamSpan struct {
+	Span
+	first bool
+}
+
+func startStreamSpan(rail miso.Rail, op string) (miso.Rail, *streamSpan) {
+	attrs := []Attr{NewAttr(AttrOperation, op)}
+	if a, ok := rail.Context().Value(apiCtxKey{}).(Api); ok && a.scope != "" {
+		attrs = append(attrs, NewAttr(AttrApp, a.scope))
+	}
+	rail, s := startSpan(rail, "dify."+op, attrs...)
+	return rail, &streamSpan{Span: s}
+}
+
+func (s *streamSpan) event(e ChatMessageEvent) {
+	switch e.Event {
+	case EventTypeMessage, EventTypeAgentMessage:
+		if !s.first {
+			s.first = true
+			s.AddEvent(SpanEventFirstToken)
+			s.SetAttributes(NewAttr(AttrConversationId, e.ConversationId), NewAttr(AttrMessageId, e.MessageId), NewAttr(AttrTaskId, e.TaskId))
+		}
+	case EventWorkflowStarted:
+		s.SetAttributes(NewAttr(AttrWorkflowRunId, e.WorkflowRunId))
+	case EventNodeStarted, EventNodeFinished:
+		attrs := []Attr{NewAttr(AttrNodeId, e.Data.NodeId), NewAttr(AttrNodeType, e.Data.NodeType), NewAttr(AttrNodeTitle, e.Data.Title)}
+		if e.Event == EventNodeFinished {
+			attrs = append(attrs, NewAttr(AttrNodeStatus, e.Data.Status))
+		}
+		s.AddEvent(e.Event, attrs...)
+	case EventTypeMessageEnd:
+		if u := e.Metadata.Usage; u != nil {
+			s.SetAttributes(NewAttr(AttrPromptTokens, u.PromptTokens), NewAttr(AttrOutputTokens, u.CompletionTokens), NewAttr(AttrTotalTokens, u.TotalTokens))
+		}
+	case EventTypeError:
+		s.SetAttributes(NewAttr(AttrErrorCode, e.Code))
+		s.AddEvent(SpanEventError, NewAttr(AttrErrorCode, e.Code), NewAttr(AttrHttpStatus, e.Status), NewAttr("exception.message", e.Message))
+	}
+}
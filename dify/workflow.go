@@ -40,11 +40,24 @@ type WorkflowRes struct {
 
 func RunWorkflow(rail miso.Rail, host string, apiKey string, req WorkflowReq) (WorkflowRes, error) {
 	req.ResponseMode = "blocking"
+	rail, span := startSpan(rail, "dify.RunWorkflow", NewAttr(AttrOperation, "RunWorkflow"))
+	defer span.End()
+
 	var res WorkflowRes
-	err := miso.NewClient(rail, host+RunWorkflowUrl).
+	err := newClient(rail, host+RunWorkflowUrl).
 		Require2xx().
 		AddAuthBearer(apiKey).
 		PostJson(req).
 		Json(&res)
+	if err != nil {
+		span.RecordError(err)
+		return res, wrapDifyErr(err, "dify.RunWorkflow failed")
+	}
+	span.SetAttributes(
+		NewAttr(AttrWorkflowRunId, res.WorkflowRunID),
+		NewAttr(AttrTaskId, res.TaskID),
+		NewAttr(AttrNodeStatus, res.Data.Status),
+		NewAttr(AttrTotalTokens, res.Data.TotalTokens),
+	)
 	return res, err
 }
@@ -0,0 +1,270 @@
+package dify
+
+import (
+	"context"
+	stdjson "encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/curtisnewbie/miso/errs"
+	"github.com/curtisnewbie/miso/miso"
+	"github.com/curtisnewbie/miso/util/json"
+	"golang.org/x/net/websocket"
+)
+
+// Types of WebSocket frames.
+const (
+	WsFrameChat = "chat" // client frame, ask a question, the fields of ChatMessageReq are embedded in the frame
+	WsFrameStop = "stop" // client frame, stop the running chat
+
+	WsFrameEvent = "event" // server frame, dify event
+	WsFrameEnd   = "end"   // server frame, the chat ends
+	WsFrameError = "error" // server frame, the chat or the client frame failed
+	WsFramePing  = "ping"  // server frame, keep-alive
+)
+
+// Frame sent by WebSocket client, e.g., {"type": "chat", "query": "...", "inputs": {}}, {"type": "stop"}.
+type WsClientFrame struct {
+	Type string `json:"type"` // chat (default) or stop
+	ChatMessageReq
+}
+
+// Frame sent to WebSocket client.
+type WsServerFrame struct {
+	Type           string             `json:"type"`
+	Event          stdjson.RawMessage `json:"event,omitempty"` // dify event as is, for event frame
+	MessageId      string             `json:"message_id,omitempty"`
+	ConversationId string             `json:"conversation_id,omitempty"`
+	Answer         string             `json:"answer,omitempty"`
+	Code           string             `json:"code,omitempty"`    // error code, for error frame
+	Message        string             `json:"message,omitempty"` // error message, for error frame
+}
+
+// Proxy chat over WebSocket, it serves the socket until the client closes it.
+//
+// Client sends chat frame (ChatMessageReq in JSON with type 'chat') to ask a question, the dify events are then sent back
+// as event frames followed by an end frame (or an error frame). Questions are answered one at a time, and the follow-up
+// questions continue the same conversation unless conversation_id is specified. Client may send stop frame to stop the
+// running chat.
+//
+// prepare is called before each chat, e.g., to set the user or to validate the request, it may be nil.
+//
+// [ProxyConfig].OnDisconnect decides what to do with the running chat when the client disconnects,
+// [ProxyConfig].KeepAliveInterval is the interval of ping frames, and [ProxyConfig].Middlewares are applied to the
+// dify events. Cross-origin handshakes are rejected.
+func ProxyWsChat(rail miso.Rail, host string, apiKey string, w http.ResponseWriter, r *http.Request,
+	prepare func(req *ChatMessageReq) error, opts ...func(c *ProxyConfig)) {
+
+	conf := newProxyConfig(opts...)
+	websocket.Server{
+		Handshake: checkWsOrigin,
+		Handler: func(ws *websocket.Conn) {
+			s := &wsSession{rail: rail, host: host, apiKey: apiKey, conf: conf, prepare: prepare, ws: ws}
+			s.serve()
+		},
+	}.ServeHTTP(w, r)
+}
+
+// Allow non-browser clients without Origin header, or same origin requests.
+func checkWsOrigin(c *websocket.Config, r *http.Request) error {
+	o := r.Header.Get("Origin")
+	if o == "" {
+		return nil
+	}
+	u, err := url.Parse(o)
+	if err != nil || u.Host != r.Host {
+		return errs.NewErrf("cross origin websocket request rejected, origin: %v, host: %v", o, r.Host)
+	}
+	c.Origin = u
+	return nil
+}
+
+type wsSession struct {
+	rail    miso.Rail
+	host    string
+	apiKey  string
+	conf    ProxyConfig
+	prepare func(req *ChatMessageReq) error
+	ws      *websocket.Conn
+
+	wmu    sync.Mutex
+	closed bool
+
+	mu             sync.Mutex
+	running        bool
+	stopping       bool
+	taskId         string
+	user           string
+	conversationId string
+	wg             sync.WaitGroup
+}
+
+func (s *wsSession) serve() {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(s.rail.Context()))
+	defer cancel()
+	streamRail := miso.NewRail(ctx)
+
+	done := make(chan struct{})
+	if s.conf.KeepAliveInterval > 0 {
+		go s.keepAlive(done)
+	}
+
+	for {
+		var msg string
+		if err := websocket.Message.Receive(s.ws, &msg); err != nil {
+			break
+		}
+		var f WsClientFrame
+		if err := json.SParseJson(msg, &f); err != nil {
+			s.send(WsServerFrame{Type: WsFrameError, Code: ErrInvalidParam.Code(), Message: "Invalid frame"})
+			continue
+		}
+		switch f.Type {
+		case "", WsFrameChat:
+			s.chat(streamRail, f.ChatMessageReq)
+		case WsFrameStop:
+			s.stop(streamRail)
+		default:
+			s.send(WsServerFrame{Type: WsFrameError, Code: ErrInvalidParam.Code(), Message: "Unknown frame type: " + f.Type})
+		}
+	}
+
+	close(done)
+	s.wmu.Lock()
+	s.closed = true
+	s.wmu.Unlock()
+
+	s.mu.Lock()
+	running := s.running
+	s.mu.Unlock()
+	if running {
+		if s.conf.OnDisconnect == DisconnectStop {
+			s.rail.Infof("WebSocket client disconnected, stopping dify chat stream")
+			s.stop(streamRail)
+			cancel()
+		} else {
+			s.rail.Infof("WebSocket client disconnected, continue consuming dify chat stream")
+		}
+	}
+	s.wg.Wait()
+}
+
+func (s *wsSession) chat(rail miso.Rail, req ChatMessageReq) {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		s.send(WsServerFrame{Type: WsFrameError, Code: ErrInvalidParam.Code(), Message: "Previous question is not answered yet"})
+		return
+	}
+	if req.ConversationId == "" {
+		req.ConversationId = s.conversationId
+	}
+	s.mu.Unlock()
+
+	if s.prepare != nil {
+		if err := s.prepare(&req); err != nil {
+			s.sendErr(err)
+			return
+		}
+	}
+	req = prepareChatReq(req).(ChatMessageReq)
+
+	s.mu.Lock()
+	s.running, s.stopping, s.taskId, s.user = true, false, "", req.User
+	s.mu.Unlock()
+
+	forward := chainProxyMiddlewares(rail, s.conf.Middlewares, func(e SseEvent) error {
+		f := WsServerFrame{Type: WsFrameEvent}
+		if stdjson.Valid([]byte(e.Data)) {
+			f.Event = stdjson.RawMessage(e.Data)
+		}
+		s.send(f)
+		return nil
+	})
+	req.OnSseEvent = func(e SseEvent) error {
+		if id := taskIdOf(e.Data); id != "" {
+			s.mu.Lock()
+			stop := s.taskId == "" && s.stopping
+			s.taskId = id
+			s.mu.Unlock()
+			if stop {
+				go s.stop(rail)
+			}
+		}
+		return forward(e)
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		res, err := StreamQueryChatBot(rail, s.host, s.apiKey, req)
+		s.mu.Lock()
+		s.running = false
+		if res.ConversationId != "" {
+			s.conversationId = res.ConversationId
+		}
+		s.mu.Unlock()
+		if err != nil {
+			s.sendErr(err)
+			return
+		}
+		s.send(WsServerFrame{Type: WsFrameEnd, MessageId: res.MessageId, ConversationId: res.ConversationId, Answer: res.Answer})
+	}()
+}
+
+// Stop the running chat, if task id is not yet known, it's stopped once the first event arrives.
+func (s *wsSession) stop(rail miso.Rail) {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return
+	}
+	s.stopping = true
+	req := StopChatMessageReq{TaskId: s.taskId, User: s.user}
+	s.mu.Unlock()
+	if req.TaskId != "" {
+		stopChatTask(rail, s.host, s.apiKey, req)
+	}
+}
+
+func (s *wsSession) sendErr(err error) {
+	f := WsServerFrame{Type: WsFrameError, Code: ErrDifyUnknown.Code(), Message: "Unknown error"}
+	var me *errs.MisoErr
+	if errors.As(err, &me) {
+		if me.Code() != "" {
+			f.Code = me.Code()
+		}
+		if me.Msg() != "" {
+			f.Message = me.Msg()
+		}
+	}
+	s.rail.Warnf("WebSocket chat failed, %v", err)
+	s.send(f)
+}
+
+func (s *wsSession) send(f WsServerFrame) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.closed {
+		return
+	}
+	if err := websocket.Message.Send(s.ws, json.TrySWriteJson(f)); err != nil {
+		s.rail.Warnf("Failed to send websocket frame, %v", err)
+	}
+}
+
+func (s *wsSession) keepAlive(done chan struct{}) {
+	tk := time.NewTicker(s.conf.KeepAliveInterval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-tk.C:
+			s.send(WsServerFrame{Type: WsFramePing})
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Package difyredis provides redis backed storage for package dify, using miso's redis middleware.
+//
+//	api := dify.Get().WithRetrieveCache(dify.NewRetrieveCache(difyredis.NewRetrieveCacheStore()))
+//
+// Redis must be initialized by miso, e.g., with 'redis.enabled: true'.
+package difyredis
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/curtisnewbie/miso-dify/dify"
+	"github.com/curtisnewbie/miso/errs"
+	"github.com/curtisnewbie/miso/middleware/redis"
+	"github.com/curtisnewbie/miso/miso"
+)
+
+// Redis backed dify.RetrieveCacheStore.
+type RetrieveCacheStore struct {
+	Prefix string // prefix of redis keys, by default 'dify:retrieve:'
+}
+
+func NewRetrieveCacheStore() *RetrieveCacheStore {
+	return &RetrieveCacheStore{Prefix: "dify:retrieve:"}
+}
+
+func (s *RetrieveCacheStore) Get(rail miso.Rail, key string) (dify.RetrieveRes, bool, error) {
+	return redis.GetJson[dify.RetrieveRes](rail, s.Prefix+key)
+}
+
+func (s *RetrieveCacheStore) Put(rail miso.Rail, key string, res dify.RetrieveRes, ttl time.Duration) error {
+	return redis.SetJson(rail, s.Prefix+key, res, ttl)
+}
+
+func (s *RetrieveCacheStore) Version(rail miso.Rail, datasetId string) (int64, error) {
+	v, ok, err := redis.Get(rail, s.versionKey(datasetId))
+	if err != nil || !ok {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, errs.Wrapf(err, "invalid retrieve cache version of dataset %v: %v", datasetId, v)
+	}
+	return n, nil
+}
+
+func (s *RetrieveCacheStore) BumpVersion(rail miso.Rail, datasetId string) error {
+	_, err := redis.Incr(rail, s.versionKey(datasetId))
+	return err
+}
+
+func (s *RetrieveCacheStore) versionKey(datasetId string) string {
+	return s.Prefix + "version:" + datasetId
+}
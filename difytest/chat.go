@@ -0,0 +1,247 @@
+package difytest
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/curtisnewbie/miso-dify/dify"
+	"github.com/curtisnewbie/miso/util/json"
+)
+
+// Chat request received by the fake server.
+type ChatCall struct {
+	Req            dify.ChatMessageReq
+	ApiKey         string
+	ConversationId string // conversation_id in request or the newly created one
+	MessageId      string
+	TaskId         string
+}
+
+// SSE frame sent by the fake server.
+type Frame struct {
+	Event string         // sse event type, dify doesn't name it's events except ping
+	Id    string         // sse event id
+	Data  map[string]any // json payload, missing event, task_id, message_id, conversation_id and created_at are filled automatically
+	Raw   string         // raw frame written as is, used to simulate malformed frames, Event, Id and Data are ignored
+
+	Delay time.Duration // delay before the frame is sent
+}
+
+// Send the frame after delay.
+func (f Frame) After(d time.Duration) Frame {
+	f.Delay = d
+	return f
+}
+
+func MessageFrame(answer string) Frame {
+	return Frame{Data: map[string]any{"event": dify.EventTypeMessage, "answer": answer}}
+}
+
+func AgentMessageFrame(answer string) Frame {
+	return Frame{Data: map[string]any{"event": dify.EventTypeAgentMessage, "answer": answer}}
+}
+
+func AgentThoughtFrame(thought string) Frame {
+	return Frame{Data: map[string]any{"event": dify.EventTypeAgentThrought, "thought": thought, "position": 1}}
+}
+
+func MessageEndFrame(resources ...dify.RetrieverResource) Frame {
+	if resources == nil {
+		resources = []dify.RetrieverResource{}
+	}
+	return Frame{Data: map[string]any{
+		"event": dify.EventTypeMessageEnd,
+		"metadata": map[string]any{
+			"retriever_resources": resources,
+			"usage": map[string]any{
+				"prompt_tokens":     10,
+				"completion_tokens": 20,
+				"total_tokens":      30,
+				"latency":           0.5,
+			},
+		},
+	}}
+}
+
+func ErrorFrame(code string, status int, message string) Frame {
+	return Frame{Data: map[string]any{"event": dify.EventTypeError, "code": code, "status": status, "message": message}}
+}
+
+func NodeStartedFrame(nodeId string, nodeType string, title string) Frame {
+	return Frame{Data: map[string]any{
+		"event": dify.EventNodeStarted,
+		"data":  map[string]any{"id": nodeId, "node_id": nodeId, "node_type": nodeType, "title": title},
+	}}
+}
+
+func NodeFinishedFrame(nodeId string, nodeType string, title string, outputs map[string]any) Frame {
+	return Frame{Data: map[string]any{
+		"event": dify.EventNodeFinished,
+		"data": map[string]any{
+			"id": nodeId, "node_id": nodeId, "node_type": nodeType, "title": title,
+			"status": "succeeded", "outputs": outputs, "elapsed_time": 0.1,
+		},
+	}}
+}
+
+func WorkflowFinishedFrame(answer string) Frame {
+	return Frame{Data: map[string]any{
+		"event": dify.EventTypeWorkflowFinished,
+		"data": map[string]any{
+			"status":  "succeeded",
+			"outputs": map[string]any{"answer": answer},
+		},
+	}}
+}
+
+// Ping frame sent by dify to keep the connection alive.
+func PingFrame() Frame {
+	return Frame{Raw: "event: ping\n\n"}
+}
+
+// Malformed frame written as is.
+func RawFrame(raw string) Frame {
+	return Frame{Raw: raw}
+}
+
+// Script the chat events.
+//
+// By default, the fake server echos the query word by word and then sends message_end.
+func (s *Server) OnChat(f func(c ChatCall) []Frame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChat = f
+}
+
+func defaultChat(c ChatCall) []Frame {
+	var frames []Frame
+	for _, w := range strings.SplitAfter(c.Req.Query, " ") {
+		frames = append(frames, MessageFrame(w))
+	}
+	return append(frames, MessageEndFrame())
+}
+
+func (s *Server) handleChat(w http.ResponseWriter, r *http.Request) {
+	var req dify.ChatMessageReq
+	if err := json.DecodeJson(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_param", err.Error())
+		return
+	}
+	if req.Query == "" {
+		writeError(w, http.StatusBadRequest, "invalid_param", "query is required")
+		return
+	}
+
+	c := ChatCall{
+		Req:            req,
+		ApiKey:         bearer(r.Header),
+		ConversationId: req.ConversationId,
+		MessageId:      s.nextId("msg"),
+		TaskId:         s.nextId("task"),
+	}
+	if c.ConversationId == "" {
+		c.ConversationId = s.nextId("conv")
+	}
+
+	s.mu.Lock()
+	script := s.onChat
+	s.mu.Unlock()
+	if script == nil {
+		script = defaultChat
+	}
+	frames := script(c)
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	for _, f := range frames {
+		if f.Delay > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(f.Delay):
+			}
+		}
+		if s.IsTaskStopped(c.TaskId) {
+			return
+		}
+		if _, err := w.Write([]byte(f.encode(c))); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+func (f Frame) encode(c ChatCall) string {
+	if f.Raw != "" {
+		return f.Raw
+	}
+	data := make(map[string]any, len(f.Data)+5)
+	for k, v := range f.Data {
+		data[k] = v
+	}
+	defaults := map[string]any{
+		"task_id":         c.TaskId,
+		"message_id":      c.MessageId,
+		"id":              c.MessageId,
+		"conversation_id": c.ConversationId,
+		"created_at":      time.Now().Unix(),
+	}
+	for k, v := range defaults {
+		if _, ok := data[k]; !ok {
+			data[k] = v
+		}
+	}
+
+	b := strings.Builder{}
+	if f.Event != "" {
+		b.WriteString(fmt.Sprintf("event: %v\n", f.Event))
+	}
+	if f.Id != "" {
+		b.WriteString(fmt.Sprintf("id: %v\n", f.Id))
+	}
+	b.WriteString("data: ")
+	b.WriteString(json.TrySWriteJson(data))
+	b.WriteString("\n\n")
+	return b.String()
+}
+
+func (s *Server) handleChatStop(w http.ResponseWriter, r *http.Request) {
+	st := s.getStore()
+	st.mu.Lock()
+	st.stopped[r.PathValue("taskId")] = struct{}{}
+	st.mu.Unlock()
+	writeJson(w, http.StatusOK, map[string]any{"result": "success"})
+}
+
+func (s *Server) handleConversationVars(w http.ResponseWriter, r *http.Request) {
+	st := s.getStore()
+	st.mu.RLock()
+	l := st.convVars[r.PathValue("conversationId")]
+	st.mu.RUnlock()
+	if l == nil {
+		l = []dify.GetConversationVarData{}
+	}
+	writeJson(w, http.StatusOK, dify.GetConversationVarRes{Limit: 100, Data: l})
+}
+
+func (s *Server) handleFeedback(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]any{"result": "success"})
+}
+
+func bearer(h http.Header) string {
+	v := strings.TrimSpace(h.Get("Authorization"))
+	if !strings.HasPrefix(v, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(v, "Bearer"))
+}
@@ -0,0 +1,537 @@
+package difytest
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/curtisnewbie/miso-dify/dify"
+	"github.com/curtisnewbie/miso/util/json"
+)
+
+// Workflow request received by the fake server.
+type WorkflowCall struct {
+	Req    dify.WorkflowReq
+	ApiKey string
+}
+
+// Retrieve request received by the fake server.
+type RetrieveCall struct {
+	DatasetId string
+	Req       dify.RetrieveReq
+	ApiKey    string
+}
+
+// Record returned by the fake retrieve endpoint.
+type RetrieveRecord struct {
+	Score        float64
+	DocumentId   string
+	DocumentName string
+	DocMetadata  map[string]any // metadata name -> value
+	SegmentId    string
+	Position     int
+	Content      string
+	Answer       string
+	ChildChunks  []RetrieveChildChunk
+}
+
+type RetrieveChildChunk struct {
+	Id       string
+	Position int
+	Content  string
+	Score    float64
+}
+
+// Script workflow outputs.
+//
+// By default, the fake server returns the inputs as outputs.
+func (s *Server) OnWorkflow(f func(c WorkflowCall) (outputs map[string]any)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onWorkflow = f
+}
+
+// Script retrieve results.
+//
+// By default, the fake server scores the stored segments of the dataset by the fraction of query terms they contain.
+func (s *Server) OnRetrieve(f func(c RetrieveCall) []RetrieveRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onRetrieve = f
+}
+
+func (s *Server) handleWorkflow(w http.ResponseWriter, r *http.Request) {
+	var req dify.WorkflowReq
+	if err := json.DecodeJson(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_param", err.Error())
+		return
+	}
+	s.mu.Lock()
+	script := s.onWorkflow
+	s.mu.Unlock()
+
+	outputs := req.Inputs
+	if script != nil {
+		outputs = script(WorkflowCall{Req: req, ApiKey: bearer(r.Header)})
+	}
+	now := time.Now().Unix()
+	runId := s.nextId("run")
+	writeJson(w, http.StatusOK, map[string]any{
+		"workflow_run_id": runId,
+		"task_id":         s.nextId("task"),
+		"data": map[string]any{
+			"id":           runId,
+			"workflow_id":  "workflow",
+			"status":       "succeeded",
+			"outputs":      outputs,
+			"elapsed_time": 0.1,
+			"total_tokens": 0,
+			"total_steps":  1,
+			"created_at":   now,
+			"finished_at":  now,
+		},
+	})
+}
+
+func (s *Server) handleUploadFile(w http.ResponseWriter, r *http.Request) {
+	file, fh, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "no_file_uploaded", err.Error())
+		return
+	}
+	defer file.Close()
+	ext := strings.TrimPrefix(filepath.Ext(fh.Filename), ".")
+	f := dify.UploadFileRes{
+		Id:        s.nextId("file"),
+		Name:      fh.Filename,
+		Size:      int(fh.Size),
+		Extension: ext,
+		MimeType:  fh.Header.Get("Content-Type"),
+	}
+	st := s.getStore()
+	st.mu.Lock()
+	st.files[f.Id] = f
+	st.mu.Unlock()
+	writeJson(w, http.StatusCreated, f)
+}
+
+func (s *Server) handleCreateDataset(w http.ResponseWriter, r *http.Request) {
+	var req dify.CreateDatasetReq
+	if err := json.DecodeJson(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_param", err.Error())
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, "invalid_param", "name is required")
+		return
+	}
+	id := s.nextId("dataset")
+	st := s.getStore()
+	st.mu.Lock()
+	st.datasets[id] = req
+	st.mu.Unlock()
+
+	now := time.Now().Unix()
+	writeJson(w, http.StatusOK, dify.CreateDatasetRes{
+		ID:                     id,
+		Name:                   req.Name,
+		Permission:             req.Permission,
+		IndexingTechnique:      req.IndexingTechnique,
+		EmbeddingModel:         req.EmbeddingModel,
+		EmbeddingModelProvider: req.EmbeddingModelProvider,
+		DataSourceType:         "upload_file",
+		Provider:               "vendor",
+		CreatedAt:              now,
+		UpdatedAt:              now,
+	})
+}
+
+func (s *Server) handleListMetadata(w http.ResponseWriter, r *http.Request) {
+	st := s.getStore()
+	st.mu.RLock()
+	l := st.metadata[r.PathValue("datasetId")]
+	st.mu.RUnlock()
+	if l == nil {
+		l = []dify.ListedDatasetMetadata{}
+	}
+	writeJson(w, http.StatusOK, dify.ListDatasetMetadataRes{DocMetadata: l})
+}
+
+func (s *Server) handleCreateDocByFile(w http.ResponseWriter, r *http.Request) {
+	var data dify.UploadDocumentApiReq
+	if v := r.FormValue("data"); v != "" {
+		if err := json.SParseJson(v, &data); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_param", err.Error())
+			return
+		}
+	}
+	file, fh, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "no_file_uploaded", err.Error())
+		return
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_param", err.Error())
+		return
+	}
+	s.createDocument(w, r.PathValue("datasetId"), fh.Filename, string(content), data.ProcessRule)
+}
+
+func (s *Server) handleCreateDocByText(w http.ResponseWriter, r *http.Request) {
+	var req dify.CreateDocumentApiReq
+	if err := json.DecodeJson(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_param", err.Error())
+		return
+	}
+	if req.Name == "" || req.Text == "" {
+		writeError(w, http.StatusBadRequest, "invalid_param", "name and text are required")
+		return
+	}
+	s.createDocument(w, r.PathValue("datasetId"), req.Name, req.Text, req.ProcessRule)
+}
+
+func (s *Server) createDocument(w http.ResponseWriter, datasetId string, name string, text string, rule dify.ProcessRule) {
+	chunks, err := dify.PreviewChunks(text, rule)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_param", err.Error())
+		return
+	}
+	doc := &Document{
+		Id:        s.nextId("doc"),
+		DatasetId: datasetId,
+		Name:      name,
+		Text:      text,
+		Batch:     s.nextId("batch"),
+		Size:      len(text),
+		CreatedAt: time.Now().Unix(),
+	}
+
+	st := s.getStore()
+	st.mu.Lock()
+	st.documents[doc.Id] = doc
+	for _, c := range chunks {
+		sg := st.addSegment(s.nextId("seg"), datasetId, doc.Id, dify.DocSegment{Content: c.Content})
+		for _, child := range c.Children {
+			sg.ChildChunks = append(sg.ChildChunks, ChildChunk{Id: s.nextId("child"), Position: len(sg.ChildChunks) + 1, Content: child.Content})
+		}
+	}
+	st.mu.Unlock()
+
+	writeJson(w, http.StatusOK, map[string]any{
+		"document": map[string]any{
+			"id":               doc.Id,
+			"name":             doc.Name,
+			"position":         1,
+			"data_source_type": "upload_file",
+			"indexing_status":  "completed",
+			"enabled":          true,
+			"tokens":           len(text),
+			"word_count":       len([]rune(text)),
+			"created_at":       doc.CreatedAt,
+		},
+		"batch": doc.Batch,
+	})
+}
+
+func (s *Server) handleUpdateDocMetadata(w http.ResponseWriter, r *http.Request) {
+	var req dify.UpdateDocMetadataReq
+	if err := json.DecodeJson(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_param", err.Error())
+		return
+	}
+	st := s.getStore()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, op := range req.OperationData {
+		doc, ok := st.documents[op.DocumentID]
+		if !ok || doc.DatasetId != r.PathValue("datasetId") {
+			writeError(w, http.StatusNotFound, "not_found", "Document not found.")
+			return
+		}
+		doc.Metadata = op.MetadataList
+	}
+	writeJson(w, http.StatusOK, map[string]any{"result": "success"})
+}
+
+func (s *Server) findDocument(datasetId string, documentId string) (Document, bool) {
+	st := s.getStore()
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	doc, ok := st.documents[documentId]
+	if !ok || doc.DatasetId != datasetId {
+		return Document{}, false
+	}
+	return *doc, true
+}
+
+func (s *Server) handleGetDocument(w http.ResponseWriter, r *http.Request) {
+	doc, ok := s.findDocument(r.PathValue("datasetId"), r.PathValue("documentId"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "Document not found.")
+		return
+	}
+	ext := strings.TrimPrefix(filepath.Ext(doc.Name), ".")
+	url := s.URL + "/files/" + doc.Id + "/file-preview"
+	writeJson(w, http.StatusOK, map[string]any{
+		"id":           doc.Id,
+		"name":         doc.Name,
+		"size":         doc.Size,
+		"extension":    ext,
+		"url":          url,
+		"download_url": url + "?as_attachment=true",
+		"mime_type":    "text/plain",
+		"created_by":   "difytest",
+		"created_at":   doc.CreatedAt,
+	})
+}
+
+func (s *Server) handleIndexingStatus(w http.ResponseWriter, r *http.Request) {
+	st := s.getStore()
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	l := []map[string]any{}
+	for _, doc := range st.documents {
+		if doc.DatasetId != r.PathValue("datasetId") || doc.Batch != r.PathValue("batch") {
+			continue
+		}
+		n := len(st.docSegments(doc.Id))
+		l = append(l, map[string]any{
+			"id":                     doc.Id,
+			"indexing_status":        "completed",
+			"processing_started_at":  doc.CreatedAt,
+			"parsing_completed_at":   doc.CreatedAt,
+			"cleaning_completed_at":  doc.CreatedAt,
+			"splitting_completed_at": doc.CreatedAt,
+			"completed_at":           doc.CreatedAt,
+			"paused_at":              nil,
+			"error":                  nil,
+			"stopped_at":             nil,
+			"completed_segments":     n,
+			"total_segments":         n,
+		})
+	}
+	writeJson(w, http.StatusOK, map[string]any{"data": l})
+}
+
+func (s *Server) handleRemoveDocument(w http.ResponseWriter, r *http.Request) {
+	datasetId, documentId := r.PathValue("datasetId"), r.PathValue("documentId")
+	if _, ok := s.findDocument(datasetId, documentId); !ok {
+		writeError(w, http.StatusNotFound, "not_found", "Document Not Exists.")
+		return
+	}
+	st := s.getStore()
+	st.mu.Lock()
+	delete(st.documents, documentId)
+	for id, sg := range st.segments {
+		if sg.DocumentId == documentId {
+			delete(st.segments, id)
+		}
+	}
+	st.mu.Unlock()
+	writeJson(w, http.StatusOK, map[string]any{"result": "success"})
+}
+
+func (s *Server) handleAddSegments(w http.ResponseWriter, r *http.Request) {
+	datasetId, documentId := r.PathValue("datasetId"), r.PathValue("documentId")
+	var req struct {
+		Segments []dify.DocSegment `json:"segments"`
+	}
+	if err := json.DecodeJson(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_param", err.Error())
+		return
+	}
+	if _, ok := s.findDocument(datasetId, documentId); !ok {
+		writeError(w, http.StatusNotFound, "not_found", "Document is not found.")
+		return
+	}
+	for _, sg := range req.Segments {
+		if strings.TrimSpace(sg.Content) == "" {
+			writeError(w, http.StatusBadRequest, "invalid_param", "Content is empty")
+			return
+		}
+	}
+
+	st := s.getStore()
+	st.mu.Lock()
+	data := make([]map[string]any, 0, len(req.Segments))
+	for _, ds := range req.Segments {
+		sg := st.addSegment(s.nextId("seg"), datasetId, documentId, ds)
+		data = append(data, segmentJson(*sg))
+	}
+	st.mu.Unlock()
+	writeJson(w, http.StatusOK, map[string]any{"data": data, "doc_form": "text_model"})
+}
+
+func (s *Server) handleAddChildChunk(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Content string `json:"content"`
+	}
+	if err := json.DecodeJson(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_param", err.Error())
+		return
+	}
+	st := s.getStore()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sg, ok := st.segments[r.PathValue("segmentId")]
+	if !ok || sg.DocumentId != r.PathValue("documentId") {
+		writeError(w, http.StatusNotFound, "not_found", "Segment is not found.")
+		return
+	}
+	c := ChildChunk{Id: s.nextId("child"), Position: len(sg.ChildChunks) + 1, Content: req.Content}
+	sg.ChildChunks = append(sg.ChildChunks, c)
+	writeJson(w, http.StatusOK, map[string]any{
+		"data": map[string]any{
+			"id":         c.Id,
+			"segment_id": sg.Id,
+			"content":    c.Content,
+			"position":   c.Position,
+			"word_count": len([]rune(c.Content)),
+			"type":       "customized",
+		},
+	})
+}
+
+func (s *Server) handleRetrieve(w http.ResponseWriter, r *http.Request) {
+	var req dify.RetrieveReq
+	if err := json.DecodeJson(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_param", err.Error())
+		return
+	}
+	c := RetrieveCall{DatasetId: r.PathValue("datasetId"), Req: req, ApiKey: bearer(r.Header)}
+
+	s.mu.Lock()
+	script := s.onRetrieve
+	s.mu.Unlock()
+	var records []RetrieveRecord
+	if script != nil {
+		records = script(c)
+	} else {
+		records = s.defaultRetrieve(c)
+	}
+
+	l := make([]map[string]any, 0, len(records))
+	for _, rec := range records {
+		children := make([]map[string]any, 0, len(rec.ChildChunks))
+		for _, cc := range rec.ChildChunks {
+			children = append(children, map[string]any{"id": cc.Id, "content": cc.Content, "position": cc.Position, "score": cc.Score})
+		}
+		sg := segmentJson(Segment{
+			Id:         rec.SegmentId,
+			DatasetId:  c.DatasetId,
+			DocumentId: rec.DocumentId,
+			Position:   rec.Position,
+			Content:    rec.Content,
+			Answer:     rec.Answer,
+		})
+		sg["document"] = map[string]any{"id": rec.DocumentId, "data_source_type": "upload_file", "name": rec.DocumentName,
+			"doc_type": nil, "doc_metadata": rec.DocMetadata}
+		l = append(l, map[string]any{"segment": sg, "child_chunks": children, "score": rec.Score, "tsne_position": nil})
+	}
+	writeJson(w, http.StatusOK, map[string]any{"query": map[string]any{"content": req.Query}, "records": l})
+}
+
+func (s *Server) defaultRetrieve(c RetrieveCall) []RetrieveRecord {
+	terms := strings.Fields(strings.ToLower(c.Req.Query))
+	if len(terms) < 1 {
+		return nil
+	}
+
+	st := s.getStore()
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	var records []RetrieveRecord
+	for _, sg := range st.segments {
+		if sg.DatasetId != c.DatasetId {
+			continue
+		}
+		content := strings.ToLower(sg.Content + " " + sg.Answer)
+		matched := 0
+		for _, t := range terms {
+			if strings.Contains(content, t) {
+				matched++
+			}
+		}
+		if matched < 1 {
+			continue
+		}
+		var docName string
+		var docMetadata map[string]any
+		if doc, ok := st.documents[sg.DocumentId]; ok {
+			docName = doc.Name
+			if len(doc.Metadata) > 0 {
+				docMetadata = map[string]any{}
+				for _, m := range doc.Metadata {
+					docMetadata[m.Name] = m.Value
+				}
+			}
+		}
+		rec := RetrieveRecord{
+			Score:        float64(matched) / float64(len(terms)),
+			DocumentId:   sg.DocumentId,
+			DocumentName: docName,
+			DocMetadata:  docMetadata,
+			SegmentId:    sg.Id,
+			Position:     sg.Position,
+			Content:      sg.Content,
+			Answer:       sg.Answer,
+		}
+		for _, cc := range sg.ChildChunks {
+			rec.ChildChunks = append(rec.ChildChunks, RetrieveChildChunk{Id: cc.Id, Position: cc.Position, Content: cc.Content, Score: rec.Score})
+		}
+		records = append(records, rec)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Score != records[j].Score {
+			return records[i].Score > records[j].Score
+		}
+		return records[i].SegmentId < records[j].SegmentId
+	})
+
+	topK := 4
+	if m := c.Req.RetrievalModel; m != nil {
+		if m.TopK > 0 {
+			topK = int(m.TopK)
+		}
+		if m.ScoreThresholdEnabled {
+			filtered := records[:0]
+			for _, rec := range records {
+				if rec.Score >= m.ScoreThreshold {
+					filtered = append(filtered, rec)
+				}
+			}
+			records = filtered
+		}
+	}
+	if len(records) > topK {
+		records = records[:topK]
+	}
+	return records
+}
+
+func segmentJson(sg Segment) map[string]any {
+	keywords := sg.Keywords
+	if keywords == nil {
+		keywords = []string{}
+	}
+	return map[string]any{
+		"id":          sg.Id,
+		"position":    sg.Position,
+		"document_id": sg.DocumentId,
+		"content":     sg.Content,
+		"answer":      sg.Answer,
+		"word_count":  len([]rune(sg.Content)),
+		"tokens":      len([]rune(sg.Content)),
+		"keywords":    keywords,
+		"hit_count":   0,
+		"enabled":     true,
+		"status":      "completed",
+	}
+}
@@ -0,0 +1,418 @@
+package difytest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/curtisnewbie/miso/errs"
+	"github.com/curtisnewbie/miso/util/json"
+)
+
+const (
+	redacted = "***"
+)
+
+var (
+	// Headers that are always redacted in fixture files.
+	RedactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+)
+
+// Fixture file that contains recorded http interactions.
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+type RecordedRequest struct {
+	Method string              `json:"method"`
+	Path   string              `json:"path"`
+	Query  string              `json:"query"`
+	Header map[string][]string `json:"header"`
+	Body   string              `json:"body"`
+}
+
+type RecordedResponse struct {
+	Status int                 `json:"status"`
+	Header map[string][]string `json:"header"`
+	Body   string              `json:"body"`   // full response body, empty if the response is streamed
+	Chunks []RecordedChunk     `json:"chunks"` // chunks of the streamed (SSE) response body
+}
+
+// Chunk of SSE response body.
+type RecordedChunk struct {
+	DelayMs int64  `json:"delay_ms"` // delay since previous chunk (or since the response header is received)
+	Data    string `json:"data"`
+}
+
+// Check whether the request matches the recorded one.
+type Matcher func(req *http.Request, body []byte, rec RecordedRequest) bool
+
+func MatchMethod(req *http.Request, body []byte, rec RecordedRequest) bool {
+	return strings.EqualFold(req.Method, rec.Method)
+}
+
+func MatchPath(req *http.Request, body []byte, rec RecordedRequest) bool {
+	return req.URL.Path == rec.Path
+}
+
+func MatchQuery(req *http.Request, body []byte, rec RecordedRequest) bool {
+	return req.URL.RawQuery == rec.Query
+}
+
+// Compare json bodies semantically, i.e., ignoring formatting and field order.
+//
+// Non-json bodies (e.g., multipart form data with random boundary) are not compared.
+func MatchJsonBody(req *http.Request, body []byte, rec RecordedRequest) bool {
+	var want any
+	if err := json.SParseJson(rec.Body, &want); err != nil {
+		return true
+	}
+	var got any
+	if err := json.ParseJson(body, &got); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(want, got)
+}
+
+// Default matchers: method, path and json body.
+var DefaultMatchers = []Matcher{MatchMethod, MatchPath, MatchJsonBody}
+
+// Load cassette from fixture file.
+func LoadCassette(fixture string) (Cassette, error) {
+	var c Cassette
+	b, err := os.ReadFile(fixture)
+	if err != nil {
+		return c, errs.Wrapf(err, "failed to read fixture file %v", fixture)
+	}
+	if err := json.ParseJson(b, &c); err != nil {
+		return c, errs.Wrapf(err, "failed to parse fixture file %v", fixture)
+	}
+	return c, nil
+}
+
+// Save cassette to fixture file.
+func SaveCassette(fixture string, c Cassette) error {
+	s, err := json.SWriteIndent(c)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(fixture), 0o755); err != nil {
+		return errs.Wrapf(err, "failed to create directory for fixture file %v", fixture)
+	}
+	if err := os.WriteFile(fixture, []byte(s), 0o644); err != nil {
+		return errs.Wrapf(err, "failed to write fixture file %v", fixture)
+	}
+	return nil
+}
+
+// Recorder is a http.RoundTripper that records the http interactions.
+//
+// Use [NewRecorder] to create one, and use dify.SetTransport to record every call in package dify.
+type Recorder struct {
+	next    http.RoundTripper
+	fixture string
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+// Create Recorder that records the interactions sent through next, call [Recorder.Save] to write the fixture file.
+//
+// If next is nil, http.DefaultTransport is used.
+func NewRecorder(fixture string, next http.RoundTripper) *Recorder {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &Recorder{next: next, fixture: fixture}
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readReqBody(req)
+	if err != nil {
+		return nil, err
+	}
+	recReq := RecordedRequest{
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Query:  req.URL.RawQuery,
+		Header: redactHeader(req.Header),
+		Body:   string(body),
+	}
+
+	resp, err := r.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	recResp := RecordedResponse{Status: resp.StatusCode, Header: redactHeader(resp.Header)}
+	if isEventStream(resp.Header) {
+		resp.Body = &recordingBody{
+			ReadCloser: resp.Body,
+			last:       time.Now(),
+			onDone: func(chunks []RecordedChunk) {
+				recResp.Chunks = chunks
+				r.append(Interaction{Request: recReq, Response: recResp})
+			},
+		}
+		return resp, nil
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	recResp.Body = string(b)
+	r.append(Interaction{Request: recReq, Response: recResp})
+	return resp, nil
+}
+
+func (r *Recorder) append(i Interaction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cassette.Interactions = append(r.cassette.Interactions, i)
+}
+
+// Recorded interactions.
+func (r *Recorder) Cassette() Cassette {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return Cassette{Interactions: append([]Interaction(nil), r.cassette.Interactions...)}
+}
+
+// Write recorded interactions to the fixture file.
+func (r *Recorder) Save() error {
+	return SaveCassette(r.fixture, r.Cassette())
+}
+
+type recordingBody struct {
+	io.ReadCloser
+	last   time.Time
+	chunks []RecordedChunk
+	once   sync.Once
+	onDone func(chunks []RecordedChunk)
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		now := time.Now()
+		b.chunks = append(b.chunks, RecordedChunk{DelayMs: now.Sub(b.last).Milliseconds(), Data: string(p[:n])})
+		b.last = now
+	}
+	if err != nil {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	b.done()
+	return b.ReadCloser.Close()
+}
+
+func (b *recordingBody) done() {
+	b.once.Do(func() { b.onDone(b.chunks) })
+}
+
+// Replayer is a http.RoundTripper that replays recorded interactions.
+//
+// Each recorded interaction is replayed at most once, in the order they were recorded.
+//
+// Use [NewReplayer] to create one, and use dify.SetTransport to replay every call in package dify.
+type Replayer struct {
+	matchers []Matcher
+
+	// Replay SSE chunks with the recorded delays, by default, chunks are replayed without delay.
+	Realtime bool
+
+	mu       sync.Mutex
+	cassette Cassette
+	used     []bool
+}
+
+// Create Replayer that replays the interactions in the fixture file.
+//
+// If matchers are not provided, [DefaultMatchers] are used.
+func NewReplayer(fixture string, matchers ...Matcher) (*Replayer, error) {
+	c, err := LoadCassette(fixture)
+	if err != nil {
+		return nil, err
+	}
+	return NewCassetteReplayer(c, matchers...), nil
+}
+
+// Create Replayer that replays the interactions in the cassette.
+//
+// If matchers are not provided, [DefaultMatchers] are used.
+func NewCassetteReplayer(c Cassette, matchers ...Matcher) *Replayer {
+	if len(matchers) < 1 {
+		matchers = DefaultMatchers
+	}
+	return &Replayer{matchers: matchers, cassette: c, used: make([]bool, len(c.Interactions))}
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readReqBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	it, ok := r.take(req, body)
+	if !ok {
+		return nil, errs.NewErrf("no recorded interaction matches request %v %v", req.Method, req.URL)
+	}
+
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%d %s", it.Response.Status, http.StatusText(it.Response.Status)),
+		StatusCode: it.Response.Status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Request:    req,
+	}
+	for k, v := range it.Response.Header {
+		resp.Header[k] = v
+	}
+
+	if len(it.Response.Chunks) > 0 {
+		pr, pw := io.Pipe()
+		go func() {
+			for _, c := range it.Response.Chunks {
+				if r.Realtime && c.DelayMs > 0 {
+					select {
+					case <-req.Context().Done():
+						pw.CloseWithError(req.Context().Err())
+						return
+					case <-time.After(time.Duration(c.DelayMs) * time.Millisecond):
+					}
+				}
+				if _, err := pw.Write([]byte(c.Data)); err != nil {
+					return
+				}
+			}
+			pw.Close()
+		}()
+		resp.Body = pr
+	} else {
+		resp.Body = io.NopCloser(strings.NewReader(it.Response.Body))
+		resp.ContentLength = int64(len(it.Response.Body))
+	}
+	return resp, nil
+}
+
+func (r *Replayer) take(req *http.Request, body []byte) (Interaction, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+outer:
+	for i, it := range r.cassette.Interactions {
+		if r.used[i] {
+			continue
+		}
+		for _, m := range r.matchers {
+			if !m(req, body, it.Request) {
+				continue outer
+			}
+		}
+		r.used[i] = true
+		return it, true
+	}
+	return Interaction{}, false
+}
+
+// Number of recorded interactions that are not replayed yet.
+func (r *Replayer) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, u := range r.used {
+		if !u {
+			n++
+		}
+	}
+	return n
+}
+
+// Create Recorder if env DIFYTEST_RECORD is true, else create Replayer.
+//
+// Error is returned if the fixture file doesn't exist when replaying, run the test with DIFYTEST_RECORD=true to record it.
+//
+// The returned save func should be called after the test to write the fixture file, it's a no-op when replaying.
+func RecordOrReplay(fixture string, next http.RoundTripper, matchers ...Matcher) (rt http.RoundTripper, save func() error, err error) {
+	if strings.EqualFold(os.Getenv("DIFYTEST_RECORD"), "true") {
+		rec := NewRecorder(fixture, next)
+		return rec, rec.Save, nil
+	}
+	if _, err := os.Stat(fixture); os.IsNotExist(err) {
+		return nil, nil, errs.NewErrf("fixture %v not found, run with DIFYTEST_RECORD=true to record it", fixture)
+	}
+	rep, err := NewReplayer(fixture, matchers...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rep, func() error { return nil }, nil
+}
+
+func readReqBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return nil, errs.Wrap(err)
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+	b, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
+
+func redactHeader(h http.Header) map[string][]string {
+	m := make(map[string][]string, len(h))
+	for k, v := range h {
+		m[k] = append([]string(nil), v...)
+	}
+	for _, k := range RedactedHeaders {
+		k = http.CanonicalHeaderKey(k)
+		v, ok := m[k]
+		if !ok {
+			continue
+		}
+		for i, s := range v {
+			if strings.HasPrefix(s, "Bearer ") {
+				v[i] = "Bearer " + redacted
+			} else {
+				v[i] = redacted
+			}
+		}
+	}
+	return m
+}
+
+func isEventStream(h http.Header) bool {
+	ct, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return ct == "text/event-stream"
+}
@@ -0,0 +1,340 @@
+// Package difytest provides an offline fake dify server for tests.
+//
+// The fake server implements the endpoints called by package dify, records every request received,
+// and supports scripted chat events, error injection, latency and malformed SSE frames.
+//
+//	srv := difytest.NewServer()
+//	defer srv.Close()
+//
+//	srv.OnChat(func(c difytest.ChatCall) []difytest.Frame {
+//		return []difytest.Frame{difytest.MessageFrame("Hello"), difytest.MessageEndFrame()}
+//	})
+//	api := dify.NewApi(srv.Host)
+package difytest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/curtisnewbie/miso/util/json"
+)
+
+// Request received by the fake server.
+type Request struct {
+	Method   string
+	Path     string
+	Query    url.Values
+	Header   http.Header
+	Body     []byte
+	Form     map[string]string // multipart form values
+	Files    map[string]string // multipart form files, form field name -> filename
+	Received time.Time
+}
+
+// Parse json body of the request.
+func (r Request) JsonBody(ptr any) error {
+	return json.ParseJson(r.Body, ptr)
+}
+
+// Bearer token in Authorization header.
+func (r Request) ApiKey() string {
+	return bearer(r.Header)
+}
+
+// Fault injected into the fake server.
+type Fault struct {
+	Method string // http method, empty matches all methods
+	Path   string // path pattern (see [path.Match]), e.g., /v1/datasets/*/retrieve, empty matches all paths
+
+	Latency time.Duration // delay before the request is handled
+	Status  int           // status code, if 0, the request is handled normally after the latency
+	Body    string        // response body, by default it's the dify error json built from Code and Message
+	Code    string        // dify error code, e.g., invalid_param, too_many_requests
+	Message string        // dify error message
+	Header  http.Header   // response headers, e.g., Retry-After
+
+	Times int // number of times the fault is applied, 0 means always
+}
+
+func (f Fault) matches(r *http.Request) bool {
+	if f.Method != "" && !strings.EqualFold(f.Method, r.Method) {
+		return false
+	}
+	if f.Path == "" {
+		return true
+	}
+	ok, _ := path.Match(f.Path, r.URL.Path)
+	return ok
+}
+
+// Fake dify server.
+//
+// Use [NewServer] to create one.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	seq      int
+	requests []Request
+	faults   []*Fault
+	apiKeys  map[string]struct{}
+	store    *store
+
+	onChat     func(c ChatCall) []Frame
+	onWorkflow func(r WorkflowCall) map[string]any
+	onRetrieve func(r RetrieveCall) []RetrieveRecord
+}
+
+// Create and start a new fake dify server.
+func NewServer() *Server {
+	s := &Server{
+		apiKeys: map[string]struct{}{},
+		store:   newStore(),
+	}
+	s.Server = httptest.NewServer(s.routes())
+	return s
+}
+
+// Host of the fake server, e.g., http://127.0.0.1:51234.
+//
+// It can be passed to dify.NewApi directly.
+func (s *Server) Host() string {
+	return s.URL
+}
+
+// Only accept the given api keys, by default any non-empty api key is accepted.
+func (s *Server) AcceptApiKeys(keys ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range keys {
+		s.apiKeys[k] = struct{}{}
+	}
+}
+
+// Inject fault into the fake server.
+func (s *Server) AddFault(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// Remove all injected faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// All requests received, in the order they were received.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp := make([]Request, len(s.requests))
+	copy(cp, s.requests)
+	return cp
+}
+
+// Requests received that match the method and path pattern (see [path.Match]).
+func (s *Server) RequestsTo(method string, pathPattern string) []Request {
+	var l []Request
+	for _, r := range s.Requests() {
+		if method != "" && !strings.EqualFold(method, r.Method) {
+			continue
+		}
+		if ok, _ := path.Match(pathPattern, r.Path); ok {
+			l = append(l, r)
+		}
+	}
+	return l
+}
+
+// Last request received, false if no request received yet.
+func (s *Server) LastRequest() (Request, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) < 1 {
+		return Request{}, false
+	}
+	return s.requests[len(s.requests)-1], true
+}
+
+// Clear recorded requests, faults and stored datasets, documents and files.
+//
+// Handlers registered using OnChat, OnWorkflow and OnRetrieve are kept.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+	s.faults = nil
+	s.store = newStore()
+}
+
+func (s *Server) nextId(prefix string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	return fmt.Sprintf("%v-%d", prefix, s.seq)
+}
+
+func (s *Server) record(r *http.Request) (Request, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return Request{}, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	rec := Request{
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Query:    r.URL.Query(),
+		Header:   r.Header.Clone(),
+		Body:     body,
+		Received: time.Now(),
+	}
+
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "multipart/form-data" {
+		if err := r.ParseMultipartForm(32 << 20); err == nil {
+			rec.Form = map[string]string{}
+			rec.Files = map[string]string{}
+			for k, v := range r.MultipartForm.Value {
+				if len(v) > 0 {
+					rec.Form[k] = v[0]
+				}
+			}
+			for k, v := range r.MultipartForm.File {
+				if len(v) > 0 {
+					rec.Files[k] = v[0].Filename
+				}
+			}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, rec)
+	s.mu.Unlock()
+	return rec, nil
+}
+
+func (s *Server) takeFault(r *http.Request) (Fault, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.faults {
+		if !f.matches(r) {
+			continue
+		}
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+			}
+		}
+		return *f, true
+	}
+	return Fault{}, false
+}
+
+func (s *Server) authorized(key string) bool {
+	if key == "" {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.apiKeys) < 1 {
+		return true
+	}
+	_, ok := s.apiKeys[key]
+	return ok
+}
+
+func (s *Server) intercept(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec, err := s.record(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_param", err.Error())
+			return
+		}
+
+		if f, ok := s.takeFault(r); ok {
+			if f.Latency > 0 {
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(f.Latency):
+				}
+			}
+			if f.Status > 0 {
+				for k, v := range f.Header {
+					w.Header()[k] = v
+				}
+				if f.Body != "" {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(f.Status)
+					_, _ = w.Write([]byte(f.Body))
+				} else {
+					writeError(w, f.Status, f.Code, f.Message)
+				}
+				return
+			}
+		}
+
+		if r.URL.Path != "/health" && !s.authorized(rec.ApiKey()) {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "Access token is invalid")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, map[string]any{"status": "ok"})
+	})
+	mux.HandleFunc("POST /v1/chat-messages", s.handleChat)
+	mux.HandleFunc("POST /v1/chat-messages/{taskId}/stop", s.handleChatStop)
+	mux.HandleFunc("GET /v1/conversations/{conversationId}/variables", s.handleConversationVars)
+	mux.HandleFunc("POST /v1/messages/{messageId}/feedbacks", s.handleFeedback)
+	mux.HandleFunc("POST /v1/workflows/run", s.handleWorkflow)
+	mux.HandleFunc("POST /v1/files/upload", s.handleUploadFile)
+	mux.HandleFunc("POST /v1/datasets", s.handleCreateDataset)
+	mux.HandleFunc("GET /v1/datasets/{datasetId}/metadata", s.handleListMetadata)
+	mux.HandleFunc("POST /v1/datasets/{datasetId}/retrieve", s.handleRetrieve)
+	mux.HandleFunc("POST /v1/datasets/{datasetId}/document/create-by-file", s.handleCreateDocByFile)
+	mux.HandleFunc("POST /v1/datasets/{datasetId}/document/create-by-text", s.handleCreateDocByText)
+	mux.HandleFunc("POST /v1/datasets/{datasetId}/documents/metadata", s.handleUpdateDocMetadata)
+	mux.HandleFunc("GET /v1/datasets/{datasetId}/documents/{documentId}/upload-file", s.handleGetDocument)
+	mux.HandleFunc("GET /v1/datasets/{datasetId}/documents/{batch}/indexing-status", s.handleIndexingStatus)
+	mux.HandleFunc("DELETE /v1/datasets/{datasetId}/documents/{documentId}", s.handleRemoveDocument)
+	mux.HandleFunc("POST /v1/datasets/{datasetId}/documents/{documentId}/segments", s.handleAddSegments)
+	mux.HandleFunc("POST /v1/datasets/{datasetId}/documents/{documentId}/segments/{segmentId}/child_chunks", s.handleAddChildChunk)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "not_found", "The requested URL was not found on the server.")
+	})
+	return s.intercept(mux)
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if v != nil {
+		b, _ := json.WriteJson(v)
+		_, _ = w.Write(b)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	if code == "" {
+		code = strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+	}
+	writeJson(w, status, map[string]any{"code": code, "message": message, "status": status})
+}
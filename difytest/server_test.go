@@ -0,0 +1,124 @@
+package difytest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/curtisnewbie/miso-dify/dify"
+	"github.com/curtisnewbie/miso/miso"
+)
+
+func TestStreamQueryChatBot(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.AcceptApiKeys("app-key")
+	api := dify.NewApi(srv.Host)
+	rail := miso.EmptyRail()
+
+	t.Run("scripted frames", func(t *testing.T) {
+		srv.Reset()
+		var calls []ChatCall
+		srv.OnChat(func(c ChatCall) []Frame {
+			calls = append(calls, c)
+			return []Frame{
+				MessageFrame("Hello"),
+				PingFrame(),
+				MessageFrame(", world"),
+				MessageEndFrame(dify.RetrieverResource{DatasetId: "ds1", SegmentId: "seg1", Content: "ref"}),
+			}
+		})
+		defer srv.OnChat(nil)
+
+		var events []string
+		res, err := api.StreamQueryChatBot(rail, "app-key", dify.ChatMessageReq{
+			Query:  "hi",
+			User:   "tester",
+			Inputs: map[string]any{"lang": "en"},
+			ChatMessageHooks: dify.ChatMessageHooks{OnSseEvent: func(e dify.SseEvent) error {
+				events = append(events, e.Data)
+				return nil
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Answer != "Hello, world" {
+			t.Errorf("answer, want %q, got %q", "Hello, world", res.Answer)
+		}
+		if len(calls) != 1 || res.ConversationId != calls[0].ConversationId || res.MessageId != calls[0].MessageId {
+			t.Errorf("conversation of the chat call is not returned, calls: %+v, res: %+v", calls, res)
+		}
+		if len(res.RetrieverResources) != 1 || res.RetrieverResources[0].SegmentId != "seg1" {
+			t.Errorf("retriever resources, got %+v", res.RetrieverResources)
+		}
+		if len(events) != 3 {
+			t.Errorf("events, want 3 (ping is skipped), got %v", len(events))
+		}
+
+		reqs := srv.RequestsTo("POST", "/v1/chat-messages")
+		if len(reqs) != 1 {
+			t.Fatalf("recorded requests, want 1, got %v", len(reqs))
+		}
+		if reqs[0].ApiKey() != "app-key" {
+			t.Errorf("api key, got %q", reqs[0].ApiKey())
+		}
+		var body dify.ChatMessageReq
+		if err := reqs[0].JsonBody(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Query != "hi" || body.User != "tester" || body.ResponseMode != "streaming" || body.Inputs["lang"] != "en" {
+			t.Errorf("request body, got %+v", body)
+		}
+	})
+
+	t.Run("error event", func(t *testing.T) {
+		srv.Reset()
+		srv.OnChat(func(c ChatCall) []Frame {
+			return []Frame{MessageFrame("partial"), ErrorFrame(dify.CodeProviderQuotaExceeded, 400, "quota exceeded")}
+		})
+		defer srv.OnChat(nil)
+
+		_, err := api.StreamQueryChatBot(rail, "app-key", dify.ChatMessageReq{Query: "hi", User: "tester"})
+		if !errors.Is(err, dify.ErrProviderQuotaExceeded) {
+			t.Fatalf("want ErrProviderQuotaExceeded, got %v", err)
+		}
+		var de *dify.DifyError
+		if !errors.As(err, &de) || de.Message != "quota exceeded" {
+			t.Errorf("want *DifyError, got %v", err)
+		}
+	})
+
+	t.Run("injected fault", func(t *testing.T) {
+		srv.Reset()
+		srv.AddFault(Fault{Method: "POST", Path: "/v1/chat-messages", Status: 429, Code: dify.CodeTooManyRequests, Message: "slow down", Times: 1})
+		defer srv.ClearFaults()
+
+		_, err := api.StreamQueryChatBot(rail, "app-key", dify.ChatMessageReq{Query: "hello there", User: "tester"})
+		if !errors.Is(err, dify.ErrTooManyRequests) {
+			t.Fatalf("want ErrTooManyRequests, got %v", err)
+		}
+
+		// fault is only applied once, default chat echos the query word by word
+		res, err := api.StreamQueryChatBot(rail, "app-key", dify.ChatMessageReq{Query: "hello there", User: "tester"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Answer != "hello there" {
+			t.Errorf("answer, want %q, got %q", "hello there", res.Answer)
+		}
+		if n := len(srv.RequestsTo("POST", "/v1/chat-messages")); n != 2 {
+			t.Errorf("recorded requests, want 2, got %v", n)
+		}
+	})
+
+	t.Run("invalid api key", func(t *testing.T) {
+		srv.Reset()
+		_, err := api.StreamQueryChatBot(rail, "other-key", dify.ChatMessageReq{Query: "hi", User: "tester"})
+		if !errors.Is(err, dify.ErrUnauthorized) {
+			t.Fatalf("want ErrUnauthorized, got %v", err)
+		}
+		if n := len(srv.Requests()); n != 1 {
+			t.Errorf("recorded requests, want 1, got %v", n)
+		}
+	})
+}
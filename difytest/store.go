@@ -0,0 +1,176 @@
+package difytest
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/curtisnewbie/miso-dify/dify"
+)
+
+// Document stored in the fake server.
+type Document struct {
+	Id        string
+	DatasetId string
+	Name      string
+	Text      string
+	Batch     string
+	Size      int
+	CreatedAt int64
+	Metadata  []dify.DocMetadata
+}
+
+// Segment stored in the fake server.
+type Segment struct {
+	Id          string
+	DatasetId   string
+	DocumentId  string
+	Position    int
+	Content     string
+	Answer      string
+	Keywords    []string
+	ChildChunks []ChildChunk
+}
+
+// Child chunk stored in the fake server.
+type ChildChunk struct {
+	Id       string
+	Position int
+	Content  string
+}
+
+type store struct {
+	mu        sync.RWMutex
+	datasets  map[string]dify.CreateDatasetReq
+	metadata  map[string][]dify.ListedDatasetMetadata
+	documents map[string]*Document
+	segments  map[string]*Segment
+	files     map[string]dify.UploadFileRes
+	convVars  map[string][]dify.GetConversationVarData
+	stopped   map[string]struct{}
+}
+
+func newStore() *store {
+	return &store{
+		datasets:  map[string]dify.CreateDatasetReq{},
+		metadata:  map[string][]dify.ListedDatasetMetadata{},
+		documents: map[string]*Document{},
+		segments:  map[string]*Segment{},
+		files:     map[string]dify.UploadFileRes{},
+		convVars:  map[string][]dify.GetConversationVarData{},
+		stopped:   map[string]struct{}{},
+	}
+}
+
+func (s *Server) getStore() *store {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.store
+}
+
+// Documents in the dataset, sorted by id.
+func (s *Server) Documents(datasetId string) []Document {
+	st := s.getStore()
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	var l []Document
+	for _, d := range st.documents {
+		if d.DatasetId == datasetId {
+			cp := *d
+			l = append(l, cp)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Id < l[j].Id })
+	return l
+}
+
+// Segments of the document, sorted by position.
+func (s *Server) Segments(documentId string) []Segment {
+	st := s.getStore()
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.docSegments(documentId)
+}
+
+// Uploaded files.
+func (s *Server) Files() []dify.UploadFileRes {
+	st := s.getStore()
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	l := make([]dify.UploadFileRes, 0, len(st.files))
+	for _, f := range st.files {
+		l = append(l, f)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Id < l[j].Id })
+	return l
+}
+
+// Add document with segments to the dataset, returns the document id.
+func (s *Server) AddDocument(datasetId string, name string, segments ...string) string {
+	st := s.getStore()
+	id := s.nextId("doc")
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.documents[id] = &Document{Id: id, DatasetId: datasetId, Name: name, Batch: s.nextId("batch")}
+	for _, c := range segments {
+		st.addSegment(s.nextId("seg"), datasetId, id, dify.DocSegment{Content: c})
+	}
+	return id
+}
+
+// Set metadata fields of the dataset returned by ListDatasetMetadata.
+func (s *Server) SetDatasetMetadata(datasetId string, l []dify.ListedDatasetMetadata) {
+	st := s.getStore()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.metadata[datasetId] = l
+}
+
+// Set conversation variables returned by GetConversationVar.
+func (s *Server) SetConversationVars(conversationId string, l []dify.GetConversationVarData) {
+	st := s.getStore()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.convVars[conversationId] = l
+}
+
+// Check whether the chat task is stopped.
+func (s *Server) IsTaskStopped(taskId string) bool {
+	st := s.getStore()
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	_, ok := st.stopped[taskId]
+	return ok
+}
+
+func (st *store) docSegments(documentId string) []Segment {
+	var l []Segment
+	for _, sg := range st.segments {
+		if sg.DocumentId == documentId {
+			cp := *sg
+			cp.ChildChunks = append([]ChildChunk(nil), sg.ChildChunks...)
+			l = append(l, cp)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Position < l[j].Position })
+	return l
+}
+
+func (st *store) addSegment(id string, datasetId string, documentId string, ds dify.DocSegment) *Segment {
+	pos := 1
+	for _, sg := range st.segments {
+		if sg.DocumentId == documentId && sg.Position >= pos {
+			pos = sg.Position + 1
+		}
+	}
+	sg := &Segment{
+		Id:         id,
+		DatasetId:  datasetId,
+		DocumentId: documentId,
+		Position:   pos,
+		Content:    ds.Content,
+		Answer:     ds.Answer,
+		Keywords:   ds.Keywords,
+	}
+	st.segments[id] = sg
+	return sg
+}